@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+)
+
+/* Access lists
+Each class of route (create, read and write, as for rate limiting) can have
+lists of IP addresses and CIDR ranges set in the config file:
+	access-create-allow, access-create-deny
+	access-read-allow,   access-read-deny
+	access-write-allow,  access-write-deny
+A client matching the class's deny list is refused, as is one not matching
+its allow list if the allow list isn't empty. Clients are identified by
+clientIP so trusted-proxies applies.
+
+The lists and the trusted-proxies are parsed when the server starts and
+again by ReloadAccessLists whenever the config file changes, an invalid
+entry keeps the previous ones.
+*/
+type accessList struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+type accessLists struct {
+	sync.RWMutex
+	classes map[string]accessList
+	proxies []*net.IPNet
+
+	// Logs once when X-Forwarded-For arrives with no trusted-proxies set
+	warnUntrusted sync.Once
+}
+
+func parseAccessList(v *viper.Viper, key string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range v.GetStringSlice(key) {
+		n, err := parseNet(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry in %s: %v", key, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Parse the access lists and trusted-proxies from the config, replacing the
+// ones in use
+func (h *Handler) ReloadAccessLists(v *viper.Viper) error {
+	proxies, err := parseAccessList(v, "trusted-proxies")
+	if err != nil {
+		return err
+	}
+	classes := make(map[string]accessList)
+	for _, class := range []string{rateCreate, rateRead, rateWrite} {
+		allow, err := parseAccessList(v, "access-"+class+"-allow")
+		if err != nil {
+			return err
+		}
+		deny, err := parseAccessList(v, "access-"+class+"-deny")
+		if err != nil {
+			return err
+		}
+		if len(allow) > 0 || len(deny) > 0 {
+			classes[class] = accessList{allow: allow, deny: deny}
+		}
+	}
+
+	h.access.Lock()
+	h.access.classes = classes
+	h.access.proxies = proxies
+	h.access.Unlock()
+	return nil
+}
+
+// Whether the list lets the IP through and why
+func (l accessList) allows(ip net.IP) (bool, string) {
+	for _, n := range l.deny {
+		if n.Contains(ip) {
+			return false, "deny " + n.String()
+		}
+	}
+	if len(l.allow) == 0 {
+		return true, "not denied"
+	}
+	for _, n := range l.allow {
+		if n.Contains(ip) {
+			return true, "allow " + n.String()
+		}
+	}
+	return false, "not allowed"
+}
+
+// Middleware refusing requests from addresses the access lists exclude
+func (h *Handler) accessControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rateClass(r)
+		h.access.RLock()
+		list, ok := h.access.classes[class]
+		h.access.RUnlock()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		addr := h.clientIP(r)
+		ip := net.ParseIP(addr)
+		allowed, reason := false, "unknown address"
+		if ip != nil {
+			allowed, reason = list.allows(ip)
+		}
+		if !allowed {
+			log.Print("warn", "denied %s request from %s to %s %s (%s)", class, addr, r.Method, r.URL.Path, reason)
+			http.Error(w, "Access denied from your address", http.StatusForbidden)
+			return
+		}
+		log.Print("info", "allowed %s request from %s (%s)", class, addr, reason)
+		next.ServeHTTP(w, r)
+	})
+}
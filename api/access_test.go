@@ -0,0 +1,141 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseNet(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{entry: "192.0.2.7", want: "192.0.2.7/32"},
+		{entry: " 192.0.2.7 ", want: "192.0.2.7/32"},
+		{entry: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{entry: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{entry: "2001:db8::1", want: "2001:db8::1/128"},
+		{entry: "2001:db8::/32", want: "2001:db8::/32"},
+		{entry: "", wantErr: true},
+		{entry: "example.com", wantErr: true},
+		{entry: "300.0.0.1", wantErr: true},
+		{entry: "10.0.0.0/33", wantErr: true},
+		{entry: "10.0.0.0/", wantErr: true},
+	}
+	for _, tt := range tests {
+		n, err := parseNet(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseNet(%q) error = %v, want error %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if err == nil && n.String() != tt.want {
+			t.Errorf("parseNet(%q) = %s, want %s", tt.entry, n, tt.want)
+		}
+	}
+}
+
+func TestAccessListAllows(t *testing.T) {
+	nets := func(entries ...string) []*net.IPNet {
+		var out []*net.IPNet
+		for _, e := range entries {
+			n, err := parseNet(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, n)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name string
+		list accessList
+		ip   string
+		want bool
+	}{
+		{"empty list", accessList{}, "192.0.2.1", true},
+		{"not denied", accessList{deny: nets("198.51.100.0/24")}, "192.0.2.1", true},
+		{"denied", accessList{deny: nets("198.51.100.0/24")}, "198.51.100.9", false},
+		{"allowed", accessList{allow: nets("10.0.0.0/8")}, "10.2.3.4", true},
+		{"not allowed", accessList{allow: nets("10.0.0.0/8")}, "192.0.2.1", false},
+		{"deny wins over allow", accessList{allow: nets("10.0.0.0/8"), deny: nets("10.0.0.5")}, "10.0.0.5", false},
+		{"allow with deny elsewhere", accessList{allow: nets("10.0.0.0/8"), deny: nets("10.0.0.5")}, "10.0.0.6", true},
+		{"ipv6 allowed", accessList{allow: nets("2001:db8::/32")}, "2001:db8::42", true},
+		{"ipv4 not in ipv6 list", accessList{allow: nets("2001:db8::/32")}, "192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.list.allows(net.ParseIP(tt.ip))
+			if got != tt.want {
+				t.Errorf("allows(%s) = %v (%s), want %v", tt.ip, got, reason, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadAccessLists(t *testing.T) {
+	v := viper.New()
+	v.Set("trusted-proxies", []string{"127.0.0.1"})
+	v.Set("access-read-deny", []string{"192.0.2.0/24"})
+
+	h := &Handler{}
+	if err := h.ReloadAccessLists(v); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := h.access.classes[rateRead]; !ok {
+		t.Error("read access list not loaded")
+	}
+	if _, ok := h.access.classes[rateCreate]; ok {
+		t.Error("empty create access list loaded")
+	}
+	if len(h.access.proxies) != 1 {
+		t.Errorf("loaded %d trusted proxies, want 1", len(h.access.proxies))
+	}
+
+	// An invalid entry keeps the lists in use
+	v.Set("access-write-allow", []string{"not an address"})
+	if err := h.ReloadAccessLists(v); err == nil {
+		t.Error("invalid access list accepted")
+	}
+	v.Set("access-write-allow", []string{})
+	v.Set("trusted-proxies", []string{"bogus"})
+	if err := h.ReloadAccessLists(v); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+	if _, ok := h.access.classes[rateRead]; !ok || len(h.access.proxies) != 1 {
+		t.Error("failed reload replaced the lists in use")
+	}
+}
@@ -0,0 +1,524 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Accounts
+Accounts are optional, pastes can still be created anonymously and managed
+with their access key unless require-auth-create or require-auth-read say
+otherwise. Users are created with the `user` command and given long-lived
+API tokens which are sent as `Authorization: Bearer <token>`, or sign in
+through OpenID Connect (see oidc.go).
+Pastes created with a token are owned by that user who can then edit and
+delete them without the access key, admins can edit and delete any paste.
+
+Only a SHA-256 hash of each token is stored so a leaked database doesn't
+leak working tokens, the token itself is only shown when it is issued.
+*/
+const (
+	userCollName  string = "users"
+	tokenCollName string = "tokens"
+
+	tokenPrefix string = "pst_"
+	tokenLength int    = 40
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// Config keys for the policies requiring authentication
+const (
+	authCreate string = "require-auth-create"
+	authRead   string = "require-auth-read"
+)
+
+var (
+	errUserNotFound = errors.New("No user found with that name")
+	errUserExists   = errors.New("A user with that name already exists")
+	errInvalidToken = errors.New("Invalid API token")
+	errLinked       = errors.New("That login is already linked to another user")
+
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+)
+
+type User struct {
+	Username  string             `json:"username" bson:"_id"`
+	Admin     bool               `json:"admin,omitempty" bson:"admin,omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt" bson:"createdAt"`
+
+	// OpenID Connect login linked to the account, see oidc.go
+	OIDCIssuer  string `json:"-" bson:"oidcIssuer,omitempty"`
+	OIDCSubject string `json:"-" bson:"oidcSubject,omitempty"`
+	OIDCEmail   string `json:"-" bson:"oidcEmail,omitempty"`
+}
+
+type apiToken struct {
+	Hash      string             `bson:"_id"`
+	Username  string             `bson:"user"`
+	Name      string             `bson:"name,omitempty"`
+	CreatedAt primitive.DateTime `bson:"createdAt"`
+}
+
+func (h *Handler) users() *mongo.Collection {
+	return h.database().Collection(userCollName)
+}
+
+func (h *Handler) tokens() *mongo.Collection {
+	return h.database().Collection(tokenCollName)
+}
+
+// Random string of n characters from charset using crypto/rand
+func secureRandomString(n int) (string, error) {
+	sb := strings.Builder{}
+	sb.Grow(n)
+	max := big.NewInt(int64(len(charset)))
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(charset[idx.Int64()])
+	}
+	return sb.String(), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (h *Handler) CreateUser(ctx context.Context, username string, admin bool) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("Invalid username: %s", username)
+	}
+
+	user := User{
+		Username:  username,
+		Admin:     admin,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if _, err := h.users().InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return errUserExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (h *Handler) Users(ctx context.Context) ([]User, error) {
+	cursor, err := h.users().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (h *Handler) findUser(ctx context.Context, username string) (*User, error) {
+	var user User
+	if err := h.users().FindOne(ctx, bson.M{"_id": username}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+/* Link a user to logins from the configured OIDC issuer with the given
+subject, or with the given email address once the provider has verified
+it. Any previous link is replaced
+*/
+func (h *Handler) LinkUser(ctx context.Context, username, subject, email string) error {
+	issuer := viper.GetString("oidc-issuer")
+	if issuer == "" {
+		return errors.New("oidc-issuer must be set to link users")
+	}
+	if (subject == "") == (email == "") {
+		return errors.New("Link a user by either subject or email")
+	}
+
+	link := bson.M{"oidcIssuer": issuer}
+	unset := bson.M{}
+	if subject != "" {
+		link["oidcSubject"] = subject
+		unset["oidcEmail"] = ""
+	} else {
+		link["oidcEmail"] = strings.ToLower(email)
+		unset["oidcSubject"] = ""
+	}
+
+	// A login can only be linked to one account
+	filter := bson.M{"_id": bson.M{"$ne": username}}
+	for k, v := range link {
+		filter[k] = v
+	}
+	n, err := h.users().CountDocuments(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return errLinked
+	}
+
+	update := bson.M{"$set": link, "$unset": unset}
+	res, err := h.users().UpdateOne(ctx, bson.M{"_id": username}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+func (h *Handler) UnlinkUser(ctx context.Context, username string) error {
+	update := bson.M{"$unset": bson.M{"oidcIssuer": "", "oidcSubject": "", "oidcEmail": ""}}
+	res, err := h.users().UpdateOne(ctx, bson.M{"_id": username}, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errUserNotFound
+	}
+	return nil
+}
+
+/* Remove a user along with their tokens, their pastes are kept but no
+longer owned by anyone so can only be managed with their access keys
+*/
+func (h *Handler) RemoveUser(ctx context.Context, username string) error {
+	res, err := h.users().DeleteOne(ctx, bson.M{"_id": username})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errUserNotFound
+	}
+
+	if _, err := h.tokens().DeleteMany(ctx, bson.M{"user": username}); err != nil {
+		return err
+	}
+	update := bson.M{"$unset": bson.M{"owner": ""}}
+	_, err = h.pastes().UpdateMany(ctx, bson.M{"owner": username}, update)
+	return err
+}
+
+// Issue a new API token for a user, the returned token can't be recovered
+func (h *Handler) IssueToken(ctx context.Context, username, name string) (string, error) {
+	if _, err := h.findUser(ctx, username); err != nil {
+		return "", err
+	}
+
+	random, err := secureRandomString(tokenLength)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + random
+
+	doc := apiToken{
+		Hash:      hashToken(token),
+		Username:  username,
+		Name:      name,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	}
+	if _, err := h.tokens().InsertOne(ctx, doc); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke a user's tokens with the given name or all of them if it is empty
+func (h *Handler) RevokeTokens(ctx context.Context, username, name string) (int64, error) {
+	filter := bson.M{"user": username}
+	if name != "" {
+		filter["name"] = name
+	}
+	res, err := h.tokens().DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (h *Handler) lookupToken(ctx context.Context, token string) (*User, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+
+	var doc apiToken
+	err := h.tokens().FindOne(ctx, bson.M{"_id": hashToken(token)}).Decode(&doc)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errInvalidToken
+		}
+		return nil, err
+	}
+
+	user, err := h.findUser(ctx, doc.Username)
+	if err == errUserNotFound {
+		return nil, errInvalidToken
+	}
+	return user, err
+}
+
+/* Middleware resolving the user from a bearer token (an API token or, with
+OIDC enabled, an ID token) or the session cookie set by logging in through
+OIDC. Requests without either are anonymous while an invalid token is
+rejected outright rather than silently treating the request as anonymous.
+*/
+func (h *Handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user *User
+		var err error
+
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		switch {
+		case ok && strings.EqualFold(scheme, "Bearer"):
+			if h.oidc != nil && !strings.HasPrefix(token, tokenPrefix) {
+				user, err = h.verifyIDToken(r.Context(), token)
+			} else {
+				user, err = h.lookupToken(r.Context(), token)
+			}
+			if err == errInvalidToken {
+				if !h.limitFailedAuth(w, r) {
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		case h.oidc != nil:
+			// An expired or tampered session just means logging in again
+			user, err = h.sessionUser(r)
+			if err == errInvalidSession {
+				clearCookie(w, sessionCookie)
+				user, err = nil, nil
+			}
+		}
+		if err != nil {
+			log.Print("error", "%v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap a handler so it is only served to authenticated users when the
+// policy given by the config key requires it
+func (h *Handler) requireAuth(policy string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if viper.GetBool(policy) && requestUser(r) == nil {
+			h.unauthorized(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// The authenticated user making the request or nil if it is anonymous
+func requestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// Whether the request may edit or delete the paste, either with its access
+// key or as its owner (or an admin)
+func canModify(r *http.Request, p *Paste, key string) bool {
+	if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(p.AccessKey)) == 1 {
+		return true
+	}
+	user := requestUser(r)
+	if user == nil {
+		return false
+	}
+	return user.Admin || (p.Owner != "" && p.Owner == user.Username)
+}
+
+/* GET /api/me
+Returns the authenticated user in JSON
+{
+	username:	String,
+	admin:		Boolean
+}
+*/
+func (h *Handler) getMe() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		user := requestUser(r)
+		if user == nil {
+			h.unauthorized(w, r)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["username"] = user.Username
+		response["admin"] = user.Admin
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* GET /api/me/pastes
+Query:
+	"page"  -> optional (1-based, defaults to 1)
+	"limit" -> optional (pastes per page, 1-100 defaults to 20)
+
+Returns the pastes owned by the authenticated user, most recently updated
+first, in JSON
+{
+	pastes:	[{ uuid: UUID, title: String, description: String, tags: []String,
+		filetype: String, filename: String, size: Number, public: Boolean,
+		updatedAt: Date, expiresAt: Date }],
+	page:	Number,
+	limit:	Number,
+	total:	Number
+}
+*/
+func (h *Handler) getMyPastes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		user := requestUser(r)
+		if user == nil {
+			h.unauthorized(w, r)
+			return
+		}
+
+		page, limit, err := parsePage(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{
+			"owner":     user.Username,
+			"expiresAt": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+		}
+		total, err := h.pastes().CountDocuments(r.Context(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		project := bson.M{"public": 1, "hidden": 1}
+		for field := range summaryProjection {
+			project[field] = summaryProjection[field]
+		}
+		opts := options.Find().
+			SetProjection(project).
+			SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+			SetSkip(int64((page - 1) * limit)).
+			SetLimit(int64(limit))
+		cursor, err := h.pastes().Find(r.Context(), filter, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var pastes []Paste
+		if err := cursor.All(r.Context(), &pastes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		summaries := make([]map[string]interface{}, 0, len(pastes))
+		for i := range pastes {
+			summary := pastes[i].summary()
+			summary["public"] = pastes[i].Public
+			if pastes[i].Hidden {
+				summary["hidden"] = true
+			}
+			summaries = append(summaries, summary)
+		}
+
+		response := make(map[string]interface{})
+		response["pastes"] = summaries
+		response["page"] = page
+		response["limit"] = limit
+		response["total"] = total
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
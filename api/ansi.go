@@ -0,0 +1,367 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"strconv"
+	"strings"
+)
+
+/* ANSI terminal output
+Pastes with the terminal filetype are expected to contain output captured
+from a shell or CI job including ANSI escape sequences. SGR sequences
+(ESC [ ... m) are converted into styled spans for the HTML view, all other
+escape sequences (cursor movement, OSC titles, etc.) are dropped as they
+have no meaning outside of a terminal.
+*/
+
+const ansiEscape byte = 0x1b
+
+// The 16 colour palette used by xterm
+var ansiPalette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00",
+	"#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00",
+	"#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+func isTerminal(filetype string) bool {
+	ft, _ := normalizeFileType(filetype)
+	return ft == "terminal"
+}
+
+type sgrState struct {
+	fg        string
+	bg        string
+	bold      bool
+	dim       bool
+	italic    bool
+	underline bool
+	strike    bool
+	inverse   bool
+}
+
+func (s sgrState) style() string {
+	fg, bg := s.fg, s.bg
+	if s.inverse {
+		fg, bg = bg, fg
+		if fg == "" {
+			fg = ansiPalette[0]
+		}
+		if bg == "" {
+			bg = ansiPalette[7]
+		}
+	}
+
+	var rules []string
+	if fg != "" {
+		rules = append(rules, "color:"+fg)
+	}
+	if bg != "" {
+		rules = append(rules, "background-color:"+bg)
+	}
+	if s.bold {
+		rules = append(rules, "font-weight:bold")
+	}
+	if s.dim {
+		rules = append(rules, "opacity:0.7")
+	}
+	if s.italic {
+		rules = append(rules, "font-style:italic")
+	}
+	switch {
+	case s.underline && s.strike:
+		rules = append(rules, "text-decoration:underline line-through")
+	case s.underline:
+		rules = append(rules, "text-decoration:underline")
+	case s.strike:
+		rules = append(rules, "text-decoration:line-through")
+	}
+
+	return strings.Join(rules, ";")
+}
+
+// Convert an index into the xterm 256 colour table into a CSS colour
+func xterm256(n int) string {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		n -= 16
+		levels := [6]int{0, 95, 135, 175, 215, 255}
+		return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[(n/6)%6], levels[n%6])
+	default:
+		v := 8 + (n-232)*10
+		return fmt.Sprintf("#%02x%02x%02x", v, v, v)
+	}
+}
+
+// Parse the colour following a 38 or 48 code, returning the colour and how
+// many extra parameters were consumed
+func extendedColour(params []int) (string, int) {
+	if len(params) >= 2 && params[0] == 5 {
+		if params[1] < 0 || params[1] > 255 {
+			return "", 2
+		}
+		return xterm256(params[1]), 2
+	}
+	if len(params) >= 4 && params[0] == 2 {
+		for _, v := range params[1:4] {
+			if v < 0 || v > 255 {
+				return "", 4
+			}
+		}
+		return fmt.Sprintf("#%02x%02x%02x", params[1], params[2], params[3]), 4
+	}
+	return "", len(params)
+}
+
+func (s *sgrState) apply(params []int) {
+	if len(params) == 0 {
+		params = []int{0}
+	}
+
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			*s = sgrState{}
+		case p == 1:
+			s.bold = true
+		case p == 2:
+			s.dim = true
+		case p == 3:
+			s.italic = true
+		case p == 4:
+			s.underline = true
+		case p == 7:
+			s.inverse = true
+		case p == 9:
+			s.strike = true
+		case p == 22:
+			s.bold, s.dim = false, false
+		case p == 23:
+			s.italic = false
+		case p == 24:
+			s.underline = false
+		case p == 27:
+			s.inverse = false
+		case p == 29:
+			s.strike = false
+		case p >= 30 && p <= 37:
+			s.fg = ansiPalette[p-30]
+		case p == 38:
+			colour, n := extendedColour(params[i+1:])
+			s.fg = colour
+			i += n
+		case p == 39:
+			s.fg = ""
+		case p >= 40 && p <= 47:
+			s.bg = ansiPalette[p-40]
+		case p == 48:
+			colour, n := extendedColour(params[i+1:])
+			s.bg = colour
+			i += n
+		case p == 49:
+			s.bg = ""
+		case p >= 90 && p <= 97:
+			s.fg = ansiPalette[p-90+8]
+		case p >= 100 && p <= 107:
+			s.bg = ansiPalette[p-100+8]
+		}
+	}
+}
+
+// Parse a semicolon separated list of SGR parameters, empty values are
+// treated as 0 as terminals do
+func sgrParams(raw string) []int {
+	if raw == "" {
+		return nil
+	}
+	parts := strings.FieldsFunc(raw, func(r rune) bool { return r == ';' || r == ':' })
+	params := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			n = 0
+		}
+		params = append(params, n)
+	}
+	return params
+}
+
+/* Walk a line calling text for each run of printable text and sgr for the
+parameters of every SGR sequence, all other escape sequences are skipped
+*/
+func scanANSI(line string, text func(string), sgr func(string)) {
+	i := 0
+	for i < len(line) {
+		esc := strings.IndexByte(line[i:], ansiEscape)
+		if esc < 0 {
+			text(line[i:])
+			return
+		}
+		if esc > 0 {
+			text(line[i : i+esc])
+		}
+		i += esc + 1
+		if i >= len(line) {
+			return
+		}
+
+		switch line[i] {
+		case '[':
+			// CSI: parameter bytes, intermediate bytes then a final byte
+			j := i + 1
+			for j < len(line) && line[j] >= 0x20 && line[j] <= 0x3f {
+				j++
+			}
+			if j >= len(line) {
+				return
+			}
+			if line[j] == 'm' {
+				sgr(line[i+1 : j])
+			}
+			i = j + 1
+		case ']':
+			// OSC: terminated by BEL or ESC \
+			j := i + 1
+			for j < len(line) {
+				if line[j] == 0x07 {
+					j++
+					break
+				}
+				if line[j] == ansiEscape && j+1 < len(line) && line[j+1] == '\\' {
+					j += 2
+					break
+				}
+				j++
+			}
+			i = j
+		default:
+			// Two byte escape sequence
+			i++
+		}
+	}
+}
+
+// Remove all ANSI escape sequences from a line
+func stripANSI(line string) string {
+	if strings.IndexByte(line, ansiEscape) < 0 {
+		return line
+	}
+	var sb strings.Builder
+	scanANSI(line, func(s string) { sb.WriteString(s) }, func(string) {})
+	return sb.String()
+}
+
+/* Convert lines of terminal output into HTML, the SGR state is carried
+across lines but spans are closed at the end of each line so every line
+is valid HTML on its own
+*/
+func ansiToHTML(content []string) []template.HTML {
+	var state sgrState
+	lines := make([]template.HTML, 0, len(content))
+
+	for _, line := range content {
+		var sb strings.Builder
+		open := false
+
+		// Spans are only opened once there is text to put in them
+		scanANSI(line,
+			func(s string) {
+				if style := state.style(); !open && style != "" {
+					sb.WriteString(`<span style="`)
+					sb.WriteString(html.EscapeString(style))
+					sb.WriteString(`">`)
+					open = true
+				}
+				sb.WriteString(html.EscapeString(s))
+			},
+			func(raw string) {
+				if open {
+					sb.WriteString("</span>")
+					open = false
+				}
+				state.apply(sgrParams(raw))
+			},
+		)
+		if open {
+			sb.WriteString("</span>")
+		}
+
+		lines = append(lines, template.HTML(sb.String()))
+	}
+
+	return lines
+}
+
+// A line of terminal output along with the comments ending on it
+type terminalLine struct {
+	HTML     template.HTML
+	Comments []Comment
+}
+
+var terminalPage = template.Must(template.New("terminal").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ if .Title }}{{ .Title }}{{ else }}{{ .UUID }}{{ end }}</title>
+<style>
+body { margin: 0; background: #1e1e1e; color: #e5e5e5; }
+header { padding: 0.5em 1em; font-family: sans-serif; font-size: 0.9em; border-bottom: 1px solid #444; }
+header a { color: #8ab4f8; }
+header h1 { font-size: 1.4em; margin: 0.25em 0; }
+header p { white-space: pre-wrap; }
+pre { margin: 0; padding: 1em; font-family: monospace; white-space: pre-wrap; }
+.comment { display: block; margin: 0.25em 0 0.5em 2em; padding: 0.25em 0.5em; border-left: 3px solid #8ab4f8; background: #2a2a2a; font-family: sans-serif; }
+.comment b { display: block; font-size: 0.85em; color: #aaa; }
+</style>
+</head>
+<body>
+<header>
+{{ if .Title }}<h1>{{ .Title }}</h1>
+{{ end }}{{ if .Description }}<p>{{ .Description }}</p>
+{{ end }}UUID: {{ .UUID }} &middot;
+Filetype: {{ .FileType }} &middot;
+{{ if .Tags }}Tags: {{ range $i, $t := .Tags }}{{ if $i }}, {{ end }}{{ $t }}{{ end }} &middot;
+{{ end }}Expires At: {{ .ExpiresAt }} &middot;
+<a href="/{{ .UUID }}/raw?strip=ansi{{ if .Key }}&key={{ .Key }}{{ else if .Share }}&share={{ .Share }}{{ end }}">raw</a>
+</header>
+<pre>{{ range .Lines }}{{ .HTML }}
+{{ range .Comments }}<span class="comment"><b>{{ .Heading }}</b>{{ .Body }}</span>{{ end }}{{ end }}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,207 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Content addressed storage
+Paste content is stored once per distinct body in the blobs collection keyed
+by the SHA-256 of the content as served by /{uuid}/raw, pastes only hold the
+hash. Each blob counts the pastes referencing it and is deleted when the
+last one is updated or deleted. Pastes removed by the TTL index never
+release their reference so blobs also expire, at the latest expiry of any
+paste that has referenced them.
+*/
+const blobCollName string = "blobs"
+
+type blob struct {
+	Hash       string             `bson:"_id"`
+	Content    []string           `bson:"content,omitempty"`
+	Codec      string             `bson:"codec,omitempty"`
+	Data       []byte             `bson:"data,omitempty"`
+	Size       int                `bson:"size"`
+	StoredSize int                `bson:"storedSize"`
+	Refs       int                `bson:"refs,omitempty"`
+	ExpiresAt  primitive.DateTime `bson:"expiresAt,omitempty"`
+}
+
+func (h *Handler) blobs() *mongo.Collection {
+	return h.database().Collection(blobCollName)
+}
+
+// Hex encoded SHA-256 of the content as served by /{uuid}/raw
+func contentHash(content []string) string {
+	hash := sha256.New()
+	for _, line := range content {
+		hash.Write([]byte(line))
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Build the blob for some content compressing it if it is over the
+// storage-compress-min-size threshold
+func newBlob(content []string) (*blob, error) {
+	b := &blob{
+		Hash:    contentHash(content),
+		Content: content,
+		Size:    contentSize(content),
+	}
+	b.StoredSize = b.Size
+
+	minSize := viper.GetInt("storage-compress-min-size")
+	if minSize <= 0 || b.Size < minSize {
+		return b, nil
+	}
+
+	codec := viper.GetString("storage-codec")
+	data, err := compressContent(codec, content)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not worth the cost of decompressing if it barely shrank
+	if len(data) >= b.Size {
+		return b, nil
+	}
+
+	b.Content = nil
+	b.Codec = codec
+	b.Data = data
+	b.StoredSize = len(data)
+	return b, nil
+}
+
+/* Add a reference to the blob holding the paste's content creating it if
+it doesn't exist yet, returns a copy of the paste to write to the database
+which points at the blob instead of holding the content itself
+*/
+func (h *Handler) storeContent(ctx context.Context, p *Paste) (*Paste, error) {
+	b, err := newBlob(p.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"_id": b.Hash}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"content":    b.Content,
+			"codec":      b.Codec,
+			"data":       b.Data,
+			"size":       b.Size,
+			"storedSize": b.StoredSize,
+		},
+		"$inc": bson.M{"refs": 1},
+		"$max": bson.M{"expiresAt": p.ExpiresAt},
+	}
+	_, err = h.blobs().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+
+	stored := *p
+	stored.ContentHash = b.Hash
+	stored.Size = b.Size
+	stored.Content = nil
+	stored.Codec = ""
+	stored.Data = nil
+	stored.StoredSize = 0
+	return &stored, nil
+}
+
+// Make sure the blob lives at least as long as a paste referencing it
+func (h *Handler) extendBlob(ctx context.Context, hash string, expiresAt primitive.DateTime) error {
+	filter := bson.M{"_id": hash}
+	update := bson.M{"$max": bson.M{"expiresAt": expiresAt}}
+	_, err := h.blobs().UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Drop a reference to a blob deleting it once nothing references it
+func (h *Handler) releaseBlob(ctx context.Context, hash string) error {
+	filter := bson.M{"_id": hash}
+	update := bson.M{"$inc": bson.M{"refs": -1}}
+	if _, err := h.blobs().UpdateOne(ctx, filter, update); err != nil {
+		return err
+	}
+
+	// A paste created in between will have incremented refs again
+	filter = bson.M{"_id": hash, "refs": bson.M{"$lte": 0}}
+	_, err := h.blobs().DeleteOne(ctx, filter)
+	return err
+}
+
+// Release a reference logging rather than returning any error, a blob left
+// behind is only wasted space until it expires
+func (h *Handler) dropBlobRef(hash string) {
+	if err := h.releaseBlob(context.Background(), hash); err != nil {
+		log.Print("error", "failed to release blob %s: %v", hash, err)
+	}
+}
+
+// Returned in place of database and decompression errors, which are logged
+var errBlobLoad = errors.New("Error loading paste content")
+
+// Load a paste's content from its blob, a missing blob means the paste is
+// gone as far as readers are concerned
+func (h *Handler) loadBlobContent(ctx context.Context, hash string) ([]string, error) {
+	var b blob
+	err := h.blobs().FindOne(ctx, bson.M{"_id": hash}).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		log.Print("error", "blob %s is missing", hash)
+		return nil, errPasteNotFound
+	}
+	if err != nil {
+		log.Print("error", "loading blob %s: %v", hash, err)
+		return nil, errBlobLoad
+	}
+	if b.Codec == "" {
+		return b.Content, nil
+	}
+	content, err := decompressContent(b.Codec, b.Data)
+	if err != nil {
+		log.Print("error", "decompressing blob %s: %v", hash, err)
+		return nil, errBlobLoad
+	}
+	return content, nil
+}
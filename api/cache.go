@@ -0,0 +1,194 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+/* Read cache
+A bounded LRU cache of pastes sitting in front of the database for the read
+handlers, so a paste linked somewhere busy doesn't turn into hundreds of
+identical FindOne calls. Entries live for at most the configured TTL (and
+never past the paste expiring), concurrent misses for the same UUID are
+collapsed into a single query and updates and deletes invalidate the entry.
+
+Cached pastes are shared between requests and must not be modified.
+*/
+type pasteCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+
+	// Bumped on every invalidation so a lookup that raced with an update
+	// doesn't store the stale paste it read
+	generation uint64
+
+	group  singleflight.Group
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key     string
+	paste   *Paste
+	expires time.Time
+}
+
+func newPasteCache(size int, ttl time.Duration) *pasteCache {
+	return &pasteCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *pasteCache) enabled() bool {
+	return c != nil && c.size > 0 && c.ttl > 0
+}
+
+func (c *pasteCache) get(key string) (*Paste, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.paste, true
+}
+
+func (c *pasteCache) add(key string, paste *Paste, generation uint64) {
+	expires := time.Now().Add(c.ttl)
+	if pasteExpiry := paste.ExpiresAt.Time(); pasteExpiry.Before(expires) {
+		expires = pasteExpiry
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cacheEntry{key: key, paste: paste, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, paste: paste, expires: expires})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *pasteCache) remove(key string) {
+	if !c.enabled() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+	c.group.Forget(key)
+}
+
+/* Return the cached paste or load it with fetch, only one fetch runs at a
+time for any key and its result is shared with every caller waiting on it
+*/
+func (c *pasteCache) fetch(
+	ctx context.Context,
+	key string,
+	fetch func(context.Context) (*Paste, error),
+) (*Paste, error) {
+	if !c.enabled() {
+		return fetch(ctx)
+	}
+
+	if paste, ok := c.get(key); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return paste, nil
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	// The shared query isn't tied to any one request being cancelled
+	v, err, _ := c.group.Do(key, func() (interface{}, error) {
+		paste, err := fetch(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		c.add(key, paste, generation)
+		return paste, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*Paste), nil
+}
+
+func (c *pasteCache) stats() (hits, misses uint64, entries int) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	entries = c.order.Len()
+	c.mu.Unlock()
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses), entries
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPasteCache(t *testing.T) {
+	type loader = func(context.Context) (*Paste, error)
+	live := func(uuid string) *Paste { return testPaste(uuid, "content") }
+
+	tests := []struct {
+		name string
+		size int
+		ttl  time.Duration
+		// Run against the cache before the final fetch of "a"
+		setup     func(c *pasteCache, fetch loader)
+		wantLoads int
+	}{
+		{"miss then hit", 10, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+		}, 1},
+		{"removed", 10, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+			c.remove("a")
+		}, 2},
+		{"other key removed", 10, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+			c.remove("b")
+		}, 1},
+		{"stale generation not stored", 10, time.Hour, func(c *pasteCache, fetch loader) {
+			c.add("a", live("a"), c.generation)
+			c.remove("b")
+			c.remove("a")
+			c.add("a", live("a"), 0)
+		}, 1},
+		{"ttl passed", 10, time.Nanosecond, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+			time.Sleep(time.Millisecond)
+		}, 2},
+		{"evicted", 2, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+			c.add("b", live("b"), c.generation)
+			c.add("c", live("c"), c.generation)
+		}, 2},
+		{"recently used kept", 2, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+			c.add("b", live("b"), c.generation)
+			c.get("a")
+			c.add("c", live("c"), c.generation)
+		}, 1},
+		{"disabled", 0, time.Hour, func(c *pasteCache, fetch loader) {
+			c.fetch(context.Background(), "a", fetch)
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newPasteCache(tt.size, tt.ttl)
+			loads := 0
+			fetch := func(context.Context) (*Paste, error) {
+				loads++
+				return live("a"), nil
+			}
+			tt.setup(c, fetch)
+			if _, err := c.fetch(context.Background(), "a", fetch); err != nil {
+				t.Fatal(err)
+			}
+			if loads != tt.wantLoads {
+				t.Errorf("loads = %d, want %d", loads, tt.wantLoads)
+			}
+		})
+	}
+}
+
+func TestPasteCacheExpiry(t *testing.T) {
+	c := newPasteCache(10, time.Hour)
+	expiring := testPaste("a", "content")
+	expiring.ExpiresAt = primitive.NewDateTimeFromTime(time.Now().Add(-time.Second))
+	c.add("a", expiring, 0)
+	if _, ok := c.get("a"); ok {
+		t.Error("expired paste served from the cache")
+	}
+}
+
+func TestPasteCacheSharedFetch(t *testing.T) {
+	c := newPasteCache(10, time.Hour)
+	var loads int32
+	release := make(chan struct{})
+	fetch := func(context.Context) (*Paste, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return testPaste("a", "content"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.fetch(context.Background(), "a", fetch); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loads := atomic.LoadInt32(&loads); loads != 1 {
+		t.Errorf("loads = %d, want 1", loads)
+	}
+	if hits, misses, entries := c.stats(); hits+misses != 10 || entries != 1 {
+		t.Errorf("stats() = %d hits, %d misses, %d entries", hits, misses, entries)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* HTTP caching
+Every paste has a revision which is bumped on each update, the ETag is a
+hash of the revision and the paste's contents so it changes whenever any
+visible field does. Read handlers use it along with the time of the last
+update to answer conditional requests with 304 Not Modified, and updates
+can send If-Match to make sure they are editing the revision they read.
+*/
+
+// Strong validator for the current state of a paste
+func (p *Paste) etag() string {
+	hash := sha256.New()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(p.Revision))
+	hash.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], uint64(p.ExpiresAt))
+	hash.Write(buf[:])
+	for _, field := range []string{p.UUID, p.FileType, p.Filename} {
+		fmt.Fprintf(hash, "%d:%s", len(field), field)
+	}
+	for _, line := range p.Content {
+		fmt.Fprintf(hash, "%d:%s", len(line), line)
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// Set the validators and Cache-Control header for a paste, responses may
+// be cached for cache-max-age seconds but never beyond the paste expiring
+func setCacheHeaders(w http.ResponseWriter, r *http.Request, p *Paste, etag string, modified primitive.DateTime) {
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Authorization, Cookie")
+	if modified != 0 {
+		w.Header().Set("Last-Modified", modified.Time().UTC().Format(http.TimeFormat))
+	}
+
+	// Reported pastes may be hidden at any moment so mustn't be kept
+	if p.Reported {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	maxAge := time.Duration(viper.GetInt("cache-max-age")) * time.Second
+	if remaining := time.Until(p.ExpiresAt.Time()); remaining < maxAge {
+		maxAge = remaining
+	}
+	if maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	// Shared caches mustn't hand private pastes to requests without the key,
+	// or pastes behind authentication to anyone who hasn't signed in
+	scope := "public"
+	if p.Private || viper.GetBool(authRead) || requestUser(r) != nil {
+		scope = "private"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(maxAge.Seconds())))
+}
+
+// Check whether the ETag matches any in an If-Match or If-None-Match
+// header, weak validators are compared by their opaque tag
+func matchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+/* Handle conditional GET requests
+Sets the caching headers and returns true if a 304 Not Modified has been
+sent in which case the handler should stop. If-None-Match takes precedence
+over If-Modified-Since as per RFC 9110
+*/
+func checkNotModified(w http.ResponseWriter, r *http.Request, p *Paste) bool {
+	return checkNotModifiedAs(w, r, p, p.etag(), p.UpdatedAt)
+}
+
+// Handle conditional GET requests for a response built from more than just
+// the paste using the given validators
+func checkNotModifiedAs(w http.ResponseWriter, r *http.Request, p *Paste, etag string, modified primitive.DateTime) bool {
+	setCacheHeaders(w, r, p, etag, modified)
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !matchesETag(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && modified != 0 {
+		since, err := http.ParseTime(ims)
+		if err != nil || modified.Time().Truncate(time.Second).After(since) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/* Compressed storage
+Content larger than storage-compress-min-size bytes is compressed before it
+is written to the database, the lines are encoded as a JSON array (so lines
+containing newlines survive the round trip) and compressed with the codec
+set by storage-codec. The codec is recorded on the document so it can be
+decompressed on read regardless of the current configuration, documents
+without a codec store their content as a plain array of lines.
+
+Content is now kept in blobs (see blob.go) but pastes written before that
+may still hold their compressed content inline.
+*/
+const (
+	codecZstd string = "zstd"
+	codecGzip string = "gzip"
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Size in bytes of the content as served by /{uuid}/raw
+func contentSize(content []string) int {
+	size := 0
+	for _, line := range content {
+		size += len(line) + 1
+	}
+	return size
+}
+
+func compressContent(codec string, content []string) ([]byte, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case codecZstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case codecGzip:
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("Unknown storage codec: %s", codec)
+	}
+}
+
+func decompressContent(codec string, compressed []byte) ([]string, error) {
+	var data []byte
+	var err error
+
+	switch codec {
+	case codecZstd:
+		data, err = zstdDecoder.DecodeAll(compressed, nil)
+	case codecGzip:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(bytes.NewReader(compressed)); err == nil {
+			data, err = io.ReadAll(gr)
+		}
+	default:
+		err = fmt.Errorf("Unknown storage codec: %s", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content []string
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Restore the content of a paste stored inline in its document
+func (p *Paste) decodeContent() error {
+	if p.Codec == "" {
+		return nil
+	}
+	content, err := decompressContent(p.Codec, p.Data)
+	if err != nil {
+		return err
+	}
+	p.Content = content
+	p.Data = nil
+	return nil
+}
@@ -0,0 +1,428 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Line comments
+Comments are attached to a line or range of lines of a paste and kept in
+their own collection so adding one doesn't touch the paste (or its ETag).
+Each comment has its own access key which, along with the paste's access
+key, allows it to be deleted. Comments share the paste's expiry and are
+removed along with it.
+*/
+const (
+	commentCollName string = "comments"
+
+	maxCommentLength int = 4096
+	maxAuthorLength  int = 64
+	maxComments      int = 500
+)
+
+var errCommentNotFound = errors.New("No comment found with that ID")
+
+type CommentBody struct {
+	Line      int    `json:"line"`
+	EndLine   int    `json:"endLine,omitempty"`
+	Author    string `json:"author,omitempty"`
+	Body      string `json:"body"`
+	AccessKey string `json:"accessKey,omitempty"`
+}
+
+type Comment struct {
+	ID        string             `json:"id" bson:"id"`
+	Paste     string             `json:"-" bson:"paste"`
+	Line      int                `json:"line" bson:"line"`
+	EndLine   int                `json:"endLine" bson:"endLine"`
+	Author    string             `json:"author,omitempty" bson:"author,omitempty"`
+	Body      string             `json:"body" bson:"body"`
+	Revision  int                `json:"revision,omitempty" bson:"revision,omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt" bson:"createdAt"`
+	ExpiresAt primitive.DateTime `json:"-" bson:"expiresAt"`
+	AccessKey string             `json:"-" bson:"accessKey"`
+}
+
+func (h *Handler) comments() *mongo.Collection {
+	return h.database().Collection(commentCollName)
+}
+
+// Create a comment on the given paste checking the line range falls within
+// its content
+func (c *Comment) NewComment(p *Paste, src *CommentBody) error {
+	if src.EndLine == 0 {
+		src.EndLine = src.Line
+	}
+	if src.Line < 1 || src.EndLine < src.Line || src.EndLine > len(p.Content) {
+		return fmt.Errorf("Invalid line range: %d-%d", src.Line, src.EndLine)
+	}
+
+	body := strings.TrimSpace(src.Body)
+	if body == "" {
+		return errors.New("Comment body is required")
+	}
+	if len(body) > maxCommentLength {
+		return fmt.Errorf("Comment must not be longer than %d characters", maxCommentLength)
+	}
+	author := strings.TrimSpace(src.Author)
+	if len(author) > maxAuthorLength || strings.ContainsAny(author, "\r\n") {
+		return fmt.Errorf("Author must be a single line of at most %d characters", maxAuthorLength)
+	}
+
+	c.ID = uuid.New().String()
+	c.Paste = p.UUID
+	c.Line = src.Line
+	c.EndLine = src.EndLine
+	c.Author = author
+	c.Body = body
+	c.Revision = p.Revision
+	c.CreatedAt = primitive.NewDateTimeFromTime(time.Now())
+	c.ExpiresAt = p.ExpiresAt
+	c.AccessKey = randomString(25)
+
+	return nil
+}
+
+// All comments on a paste ordered by the lines they refer to
+func (h *Handler) listComments(ctx context.Context, uuidStr string) ([]Comment, error) {
+	opts := options.Find().SetSort(bson.D{
+		{Key: "endLine", Value: 1},
+		{Key: "line", Value: 1},
+		{Key: "createdAt", Value: 1},
+	})
+	cursor, err := h.comments().Find(ctx, bson.M{"paste": uuidStr}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := []Comment{}
+	if err := cursor.All(ctx, &comments); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// Keep the comments on a paste expiring with it when its expiry changes
+func (h *Handler) expireComments(ctx context.Context, uuidStr string, expiresAt primitive.DateTime) {
+	filter := bson.M{"paste": uuidStr}
+	update := bson.M{"$set": bson.M{"expiresAt": expiresAt}}
+	if _, err := h.comments().UpdateMany(ctx, filter, update); err != nil {
+		log.Print("error", "failed to update comment expiry for %s: %v", uuidStr, err)
+	}
+}
+
+func (h *Handler) deleteComments(ctx context.Context, uuidStr string) {
+	if _, err := h.comments().DeleteMany(ctx, bson.M{"paste": uuidStr}); err != nil {
+		log.Print("error", "failed to delete comments for %s: %v", uuidStr, err)
+	}
+}
+
+// Validator for a view of a paste including its comments, changes whenever
+// the paste changes or a comment is added or removed
+func commentsETag(etag string, comments []Comment) string {
+	if len(comments) == 0 {
+		return etag
+	}
+	hash := sha256.New()
+	hash.Write([]byte(etag))
+	for _, c := range comments {
+		hash.Write([]byte(c.ID))
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// Time the paste or any of its comments last changed
+func commentsModified(p *Paste, comments []Comment) primitive.DateTime {
+	modified := p.UpdatedAt
+	for _, c := range comments {
+		if c.CreatedAt > modified {
+			modified = c.CreatedAt
+		}
+	}
+	return modified
+}
+
+// Group comments by the last line they refer to so they can be displayed
+// straight after it
+func commentsByLine(comments []Comment) map[int][]Comment {
+	byLine := make(map[int][]Comment)
+	for _, c := range comments {
+		byLine[c.EndLine] = append(byLine[c.EndLine], c)
+	}
+	return byLine
+}
+
+// Heading shown above a comment in the HTML views
+func (c Comment) Heading() string {
+	lines := fmt.Sprintf("line %d", c.Line)
+	if c.EndLine != c.Line {
+		lines = fmt.Sprintf("lines %d-%d", c.Line, c.EndLine)
+	}
+	if c.Author == "" {
+		return lines
+	}
+	return lines + " (" + c.Author + ")"
+}
+
+/* POST /api/{uuid}/comments
+r.Body:
+	"line"    -> required (1-based line number)
+	"endLine" -> optional (last line of the range, defaults to line)
+	"author"  -> optional
+	"body"    -> required
+
+Adds a comment to a paste and returns a JSON document
+{
+	id:		String,
+	accessKey:	String,
+	line:		Number,
+	endLine:	Number,
+	createdAt:	Date
+}
+*/
+func (h *Handler) createComment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+
+		// Load body into struct
+		var body CommentBody
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		paste, err := h.findReadablePaste(r, uuidStr)
+		if err != nil {
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var comment Comment
+		if err := comment.NewComment(paste, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		count, err := h.comments().CountDocuments(r.Context(), bson.M{"paste": uuidStr})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if count >= int64(maxComments) {
+			http.Error(w, fmt.Sprintf("Paste already has %d comments", maxComments), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := h.comments().InsertOne(r.Context(), comment); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["id"] = comment.ID
+		response["accessKey"] = comment.AccessKey
+		response["line"] = comment.Line
+		response["endLine"] = comment.EndLine
+		response["createdAt"] = comment.CreatedAt.Time().String()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* GET /api/{uuid}/comments
+Returns the comments on a paste ordered by line in JSON
+{
+	comments: [{ id: String, line: Number, endLine: Number, author: String,
+		body: String, revision: Number, createdAt: Date }]
+}
+revision is the revision of the paste the comment was made against
+*/
+func (h *Handler) getComments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+
+		if _, err := h.findReadablePaste(r, uuidStr); err != nil {
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		comments, err := h.listComments(r.Context(), uuidStr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["comments"] = comments
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* DELETE /api/{uuid}/comments/{id}
+r.Body:
+	"accessKey" -> required (the comment's or the paste's access key) unless
+	               authenticated as the paste's owner
+
+Deletes a comment from a paste
+*/
+func (h *Handler) deleteComment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+		id, _ := mux.Vars(r)["id"]
+
+		// Load body into struct
+		body := struct {
+			AccessKey string `json:"accessKey,omitempty"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var comment Comment
+		filter := bson.M{"paste": uuidStr, "id": id}
+		if err := h.comments().FindOne(r.Context(), filter).Decode(&comment); err != nil {
+			if err == mongo.ErrNoDocuments {
+				http.Error(w, errCommentNotFound.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Either the comment's author or whoever can modify the paste can
+		// delete it
+		authorized := body.AccessKey != "" &&
+			subtle.ConstantTimeCompare([]byte(body.AccessKey), []byte(comment.AccessKey)) == 1
+		if !authorized {
+			paste, err := h.loadPaste(r.Context(), uuidStr)
+			if err != nil && err != errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			authorized = err == nil && canModify(r, paste, body.AccessKey)
+		}
+		if !authorized {
+			http.Error(w, "Invalid access key", http.StatusUnauthorized)
+			return
+		}
+
+		if _, err := h.comments().DeleteOne(r.Context(), filter); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+/* Filetype detection
+When a paste is created without a filetype the language is guessed from
+(in order of how much they are trusted) editor modelines, the filename
+given by the client, a shebang line and finally heuristics over the
+content itself. The result is stored alongside the paste with a confidence
+between 0 and 1 and the method used, a filetype given by the client always
+takes precedence and is never overridden.
+*/
+type Detection struct {
+	FileType   string  `json:"filetype" bson:"filetype"`
+	Confidence float64 `json:"confidence" bson:"confidence"`
+	Method     string  `json:"method" bson:"method"`
+}
+
+const (
+	// Only the start and end of a paste are checked for modelines and only
+	// the start is used for content heuristics
+	modelineLines  int = 5
+	heuristicLines int = 200
+)
+
+// Emacs modelines either set mode: or hold the mode alone, so
+// -*- coding: utf-8 -*- doesn't name one
+var (
+	vimModeline   = regexp.MustCompile(`(?:^|\s)(?:vim?|ex):.*?\b(?:ft|filetype|syntax)=([A-Za-z0-9_+-]+)`)
+	emacsModeline = regexp.MustCompile(`-\*-\s*(?:(?:.*?[;\s])?mode:\s*([A-Za-z0-9_+-]+)\s*;?.*?|([A-Za-z0-9_+-]+)\s*)-\*-`)
+	ansiSGR       = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+// Interpreters named in shebang lines
+var detectInterpreters = map[string]string{
+	"sh":      "bash",
+	"bash":    "bash",
+	"zsh":     "bash",
+	"dash":    "bash",
+	"ksh":     "bash",
+	"python":  "python",
+	"python2": "python",
+	"python3": "python",
+	"node":    "javascript",
+	"deno":    "typescript",
+	"ts-node": "typescript",
+	"ruby":    "ruby",
+	"perl":    "perl",
+	"php":     "php",
+	"lua":     "lua",
+	"make":    "makefile",
+}
+
+/* Content heuristics
+Each pattern that matches anywhere in the sampled lines adds its weight to
+the language's score, the language with the highest score wins if it
+scored enough to be more than a guess
+*/
+type heuristic struct {
+	pattern *regexp.Regexp
+	weight  int
+}
+
+func rules(weight int, patterns ...string) []heuristic {
+	hs := make([]heuristic, 0, len(patterns))
+	for _, p := range patterns {
+		hs = append(hs, heuristic{regexp.MustCompile("(?m)" + p), weight})
+	}
+	return hs
+}
+
+var detectHeuristics = map[string][]heuristic{
+	"go": append(
+		rules(3, `^package [a-z_][a-z0-9_]*$`, `^func (\([^)]*\) )?[A-Za-z_]\w*\(`),
+		rules(1, `^import \($`, `:= `, `\berr != nil\b`)...,
+	),
+	"python": append(
+		rules(3, `^def [A-Za-z_]\w*\(.*\):$`, `^if __name__ == .__main__.:$`),
+		rules(1, `^(from [\w.]+ )?import [\w.]+`, `^class \w+(\(.*\))?:$`, `\bself\.`, `^\s+elif .*:$`)...,
+	),
+	"javascript": append(
+		rules(2, `\bconsole\.log\(`, `\brequire\(['"]`, `^export default\b`),
+		rules(1, `\b(const|let) \w+ = `, `=> \{`, `\bfunction \w*\(`)...,
+	),
+	"typescript": rules(3, `^(export )?interface \w+ \{`, `:\s*(string|number|boolean)(\[\])?[;,)=]`),
+	"rust": append(
+		rules(3, `^\s*fn main\(\)`, `\blet mut\b`, `^use \w+::`),
+		rules(1, `\bimpl\b`, `\bpub fn\b`, `println!\(`)...,
+	),
+	"c": append(
+		rules(3, `^#include <[\w/]+\.h>`),
+		rules(1, `^int main\(`, `\bprintf\(`, `\bmalloc\(`)...,
+	),
+	"cpp": rules(3, `^#include <(iostream|vector|string|memory|map)>`, `\bstd::`, `^using namespace std;`),
+	"java": append(
+		rules(3, `^public (final )?class \w+`, `\bSystem\.out\.print`),
+		rules(1, `^import java\.`, `public static void main\(`)...,
+	),
+	"php":  rules(5, `^<\?php`),
+	"ruby": rules(2, `^require ['"]`, `^\s*def \w+[?!]?(\(.*\))?$`, `^\s*end$`, `\bputs\b`),
+	"bash": append(
+		rules(2, `^\s*(export )?[A-Z_]+=`, `^\s*(if|while) \[\[? `, `^\s*fi$`, `^\s*done$`),
+		rules(1, `\$\{\w+\}`, `^\s*echo `)...,
+	),
+	"sql": rules(2,
+		`(?i)^\s*SELECT .* FROM `,
+		`(?i)^\s*INSERT INTO `,
+		`(?i)^\s*CREATE (TABLE|INDEX|VIEW) `,
+		`(?i)^\s*UPDATE \w+ SET `,
+	),
+	"diff": rules(3, `^diff --git `, `^@@ -\d+(,\d+)? \+\d+(,\d+)? @@`, `^--- (a/|\S)`, `^\+\+\+ (b/|\S)`),
+	"dockerfile": append(
+		rules(3, `^FROM \S+`),
+		rules(2, `^(RUN|CMD|ENTRYPOINT|COPY|WORKDIR|EXPOSE) `)...,
+	),
+	"yaml": append(
+		rules(2, `^---$`),
+		rules(1, `^[\w-]+:( .*)?$`, `^\s+- [\w"']`)...,
+	),
+	"toml": rules(2, `^\[[\w.-]+\]$`, `^[\w-]+ = ("|\d|\[|true|false)`),
+	"html": rules(4, `(?i)^<!DOCTYPE html`, `(?i)<html[\s>]`, `(?i)<(div|body|head|script)[\s>]`),
+	"xml":  rules(4, `^<\?xml `),
+	"css":  rules(2, `^[.#]?[\w-]+( [.#]?[\w-]+)* \{$`, `^\s+[\w-]+: [^;]+;$`),
+	"markdown": append(
+		rules(2, "^#{1,6} \\S", "^```"),
+		rules(1, `^\s*[-*] \S`, `\[[^\]]+\]\([^)]+\)`, `^> `)...,
+	),
+}
+
+// Guess the filetype of a paste, falling back to plaintext
+func detectFileType(filename string, content []string) Detection {
+	if ft := detectModeline(content); ft != "" {
+		return Detection{FileType: ft, Confidence: 0.95, Method: "modeline"}
+	}
+	if ft := detectFilename(filename); ft != "" {
+		return Detection{FileType: ft, Confidence: 0.9, Method: "filename"}
+	}
+	if ft := detectShebang(content); ft != "" {
+		return Detection{FileType: ft, Confidence: 0.9, Method: "shebang"}
+	}
+	if d, ok := detectContent(content); ok {
+		return d
+	}
+	return Detection{FileType: "plaintext", Confidence: 0, Method: "default"}
+}
+
+func detectModeline(content []string) string {
+	// Modelines naming a filetype that isn't registered are ignored
+	check := func(line string) string {
+		var mode string
+		if m := vimModeline.FindStringSubmatch(line); m != nil {
+			mode = m[1]
+		} else if m := emacsModeline.FindStringSubmatch(line); m != nil {
+			mode = m[1]
+			if mode == "" {
+				mode = m[2]
+			}
+		}
+		ft, _ := normalizeFileType(mode)
+		return ft
+	}
+
+	for i := 0; i < len(content) && i < modelineLines; i++ {
+		if ft := check(content[i]); ft != "" {
+			return ft
+		}
+	}
+	for i := len(content) - 1; i >= modelineLines && i >= len(content)-modelineLines; i-- {
+		if ft := check(content[i]); ft != "" {
+			return ft
+		}
+	}
+	return ""
+}
+
+func detectFilename(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	ft, _ := fileTypeForFilename(filename)
+	return ft
+}
+
+func detectShebang(content []string) string {
+	if len(content) == 0 || !strings.HasPrefix(content[0], "#!") {
+		return ""
+	}
+	fields := strings.Fields(strings.TrimPrefix(content[0], "#!"))
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// Skip over env and any of its flags to find the interpreter
+	interp := filepath.Base(fields[0])
+	if interp == "env" {
+		interp = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				interp = filepath.Base(f)
+				break
+			}
+		}
+	}
+
+	if ft, ok := detectInterpreters[interp]; ok {
+		return ft
+	}
+	// Versioned interpreters such as python3.11
+	return detectInterpreters[strings.TrimRight(interp, "0123456789.")]
+}
+
+func detectContent(content []string) (Detection, bool) {
+	sample := content
+	if len(sample) > heuristicLines {
+		sample = sample[:heuristicLines]
+	}
+	text := strings.Join(sample, "\n")
+	if strings.TrimSpace(text) == "" {
+		return Detection{}, false
+	}
+
+	// Structured formats that can be checked exactly
+	if ansiSGR.MatchString(text) {
+		return Detection{FileType: "terminal", Confidence: 0.8, Method: "content"}, true
+	}
+	trimmed := strings.TrimSpace(text)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) &&
+		len(sample) == len(content) && json.Valid([]byte(strings.Join(content, "\n"))) {
+		return Detection{FileType: "json", Confidence: 0.9, Method: "content"}, true
+	}
+
+	best, bestScore, total := "", 0, 0
+	for ft, hs := range detectHeuristics {
+		score := 0
+		for _, h := range hs {
+			if h.pattern.MatchString(text) {
+				score += h.weight
+			}
+		}
+		total += score
+		if score > bestScore || (score == bestScore && score > 0 && ft < best) {
+			best, bestScore = ft, score
+		}
+	}
+
+	// A single weak match is not enough to go on
+	if bestScore < 3 {
+		return Detection{}, false
+	}
+
+	// Confidence is the share of the total score that went to the winner,
+	// capped below the more reliable methods
+	confidence := math.Round(float64(bestScore)/float64(total+1)*100) / 100
+	if confidence > 0.8 {
+		confidence = 0.8
+	}
+
+	return Detection{FileType: best, Confidence: confidence, Method: "content"}, true
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import "testing"
+
+func TestDetectModeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []string
+		want    string
+	}{
+		{"vim ft", []string{"# vim: set ft=python :"}, "python"},
+		{"vim filetype alias", []string{"// vim: filetype=py"}, "python"},
+		{"vi syntax", []string{"/* vi: syntax=c */"}, "c"},
+		{"emacs mode", []string{"# -*- mode: python -*-"}, "python"},
+		{"emacs mode with variables", []string{"# -*- coding: utf-8; mode: python -*-"}, "python"},
+		{"emacs mode alone", []string{"/* -*- c -*- */"}, "c"},
+		{"emacs coding only", []string{"# -*- coding: utf-8 -*-", "print(1)"}, ""},
+		{"emacs unknown mode", []string{"-*- mode: nosuchlang -*-"}, ""},
+		{"no modeline", []string{"hello", "world"}, ""},
+		{"modeline at end", []string{"a", "b", "c", "d", "e", "f", "g", "# vim: ft=python"}, "python"},
+		{"modeline in middle ignored", []string{"a", "b", "c", "d", "e", "# vim: ft=python", "f", "g", "h", "i", "j", "k"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectModeline(tt.content); got != tt.want {
+				t.Errorf("detectModeline(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmacsModelineNeedsMode(t *testing.T) {
+	for _, line := range []string{
+		"# -*- coding: utf-8 -*-",
+		"# -*- coding: latin-1; indent-tabs-mode: nil -*-",
+	} {
+		if m := emacsModeline.FindStringSubmatch(line); m != nil && m[1]+m[2] != "" {
+			t.Errorf("emacsModeline matched %q naming mode %q", line, m[1]+m[2])
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/h5law/paste-server/logger"
+)
+
+/* Filetype registry
+Every filetype a paste can have is listed here with its canonical name, any
+aliases clients may send instead, the file extensions and filenames used
+to detect it and the MIME type used when serving the raw content. Incoming
+filetypes are normalized to their canonical name so "py", "Python" and
+"python" all end up stored as "python".
+*/
+type FileType struct {
+	Name       string   `json:"name"`
+	Aliases    []string `json:"aliases,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	Filenames  []string `json:"filenames,omitempty"`
+	MIME       string   `json:"mime"`
+}
+
+var fileTypes = []FileType{
+	{Name: "plaintext", Aliases: []string{"text", "txt", "plain", "none"}, Extensions: []string{".txt", ".log"}, Filenames: []string{".gitignore"}, MIME: "text/plain"},
+	{Name: "terminal", Aliases: []string{"ansi", "console"}, Extensions: []string{".ansi"}, MIME: "text/plain"},
+	{Name: "markdown", Aliases: []string{"md", "gfm"}, Extensions: []string{".md", ".markdown"}, MIME: "text/markdown"},
+	{Name: "go", Aliases: []string{"golang"}, Extensions: []string{".go"}, MIME: "text/x-go"},
+	{Name: "gomod", Filenames: []string{"go.mod"}, MIME: "text/plain"},
+	{Name: "python", Aliases: []string{"py", "python3", "py3"}, Extensions: []string{".py", ".pyw"}, MIME: "text/x-python"},
+	{Name: "javascript", Aliases: []string{"js", "node", "jsx"}, Extensions: []string{".js", ".mjs", ".cjs", ".jsx"}, MIME: "text/javascript"},
+	{Name: "typescript", Aliases: []string{"ts", "tsx"}, Extensions: []string{".ts", ".tsx"}, MIME: "application/typescript"},
+	{Name: "json", Extensions: []string{".json"}, MIME: "application/json"},
+	{Name: "yaml", Aliases: []string{"yml"}, Extensions: []string{".yaml", ".yml"}, MIME: "application/yaml"},
+	{Name: "toml", Extensions: []string{".toml"}, MIME: "application/toml"},
+	{Name: "ini", Aliases: []string{"cfg", "conf", "dosini"}, Extensions: []string{".ini", ".cfg", ".conf"}, MIME: "text/plain"},
+	{Name: "csv", Extensions: []string{".csv"}, MIME: "text/csv"},
+	{Name: "xml", Aliases: []string{"xsd", "xsl"}, Extensions: []string{".xml", ".xsd", ".xsl"}, MIME: "application/xml"},
+	{Name: "html", Aliases: []string{"htm", "xhtml"}, Extensions: []string{".html", ".htm", ".xhtml"}, MIME: "text/html"},
+	{Name: "css", Extensions: []string{".css"}, MIME: "text/css"},
+	{Name: "scss", Aliases: []string{"sass"}, Extensions: []string{".scss", ".sass"}, MIME: "text/x-scss"},
+	{Name: "c", Aliases: []string{"h"}, Extensions: []string{".c", ".h"}, MIME: "text/x-c"},
+	{Name: "cpp", Aliases: []string{"c++", "cxx", "cc", "hpp"}, Extensions: []string{".cc", ".cpp", ".cxx", ".hpp", ".hh"}, MIME: "text/x-c++"},
+	{Name: "csharp", Aliases: []string{"cs", "c#"}, Extensions: []string{".cs"}, MIME: "text/x-csharp"},
+	{Name: "java", Extensions: []string{".java"}, MIME: "text/x-java"},
+	{Name: "kotlin", Aliases: []string{"kt"}, Extensions: []string{".kt", ".kts"}, MIME: "text/x-kotlin"},
+	{Name: "rust", Aliases: []string{"rs"}, Extensions: []string{".rs"}, MIME: "text/x-rust"},
+	{Name: "ruby", Aliases: []string{"rb"}, Extensions: []string{".rb"}, Filenames: []string{"gemfile", "rakefile"}, MIME: "text/x-ruby"},
+	{Name: "php", Extensions: []string{".php"}, MIME: "text/x-php"},
+	{Name: "bash", Aliases: []string{"sh", "shell", "zsh", "ksh"}, Extensions: []string{".sh", ".bash", ".zsh"}, Filenames: []string{".bashrc", ".zshrc", ".profile"}, MIME: "text/x-shellscript"},
+	{Name: "sql", Extensions: []string{".sql"}, MIME: "application/sql"},
+	{Name: "diff", Aliases: []string{"patch"}, Extensions: []string{".diff", ".patch"}, MIME: "text/x-diff"},
+	{Name: "dockerfile", Aliases: []string{"docker"}, Extensions: []string{".dockerfile"}, Filenames: []string{"dockerfile"}, MIME: "text/plain"},
+	{Name: "makefile", Aliases: []string{"make", "mk"}, Extensions: []string{".mk"}, Filenames: []string{"makefile", "gnumakefile"}, MIME: "text/x-makefile"},
+	{Name: "cmake", Extensions: []string{".cmake"}, Filenames: []string{"cmakelists.txt"}, MIME: "text/x-cmake"},
+	{Name: "lua", Extensions: []string{".lua"}, MIME: "text/x-lua"},
+	{Name: "perl", Aliases: []string{"pl"}, Extensions: []string{".pl", ".pm"}, MIME: "text/x-perl"},
+	{Name: "swift", Extensions: []string{".swift"}, MIME: "text/x-swift"},
+	{Name: "haskell", Aliases: []string{"hs"}, Extensions: []string{".hs"}, MIME: "text/x-haskell"},
+	{Name: "elixir", Aliases: []string{"ex", "exs"}, Extensions: []string{".ex", ".exs"}, MIME: "text/x-elixir"},
+	{Name: "hcl", Aliases: []string{"terraform", "tf"}, Extensions: []string{".tf", ".hcl"}, MIME: "text/plain"},
+	{Name: "protobuf", Aliases: []string{"proto"}, Extensions: []string{".proto"}, MIME: "text/plain"},
+}
+
+// MIME types a browser would render or execute rather than display, raw
+// content of these filetypes is always served as text/plain. Scripts and
+// stylesheets are included so pastes can't be loaded by pages on the same
+// origin as a script or style source
+var activeMIME = map[string]bool{
+	"text/html":              true,
+	"application/xml":        true,
+	"application/xhtml+xml":  true,
+	"image/svg+xml":          true,
+	"text/javascript":        true,
+	"application/javascript": true,
+	"text/css":               true,
+}
+
+var (
+	fileTypeNames     = make(map[string]*FileType)
+	fileTypeExts      = make(map[string]*FileType)
+	fileTypeFilenames = make(map[string]*FileType)
+)
+
+func init() {
+	sort.Slice(fileTypes, func(i, j int) bool { return fileTypes[i].Name < fileTypes[j].Name })
+
+	for i := range fileTypes {
+		ft := &fileTypes[i]
+		fileTypeNames[ft.Name] = ft
+		for _, alias := range ft.Aliases {
+			fileTypeNames[alias] = ft
+		}
+		for _, ext := range ft.Extensions {
+			fileTypeExts[ext] = ft
+		}
+		for _, name := range ft.Filenames {
+			fileTypeFilenames[name] = ft
+		}
+	}
+}
+
+// Return the canonical name for a filetype or one of its aliases
+func normalizeFileType(filetype string) (string, bool) {
+	ft, ok := fileTypeNames[strings.ToLower(strings.TrimSpace(filetype))]
+	if !ok {
+		return "", false
+	}
+	return ft.Name, true
+}
+
+// Return the filetype matching a filename or its extension
+func fileTypeForFilename(filename string) (string, bool) {
+	base := strings.ToLower(filepath.Base(filename))
+	if ft, ok := fileTypeFilenames[base]; ok {
+		return ft.Name, true
+	}
+	if strings.HasPrefix(base, "dockerfile.") {
+		return "dockerfile", true
+	}
+	if ft, ok := fileTypeExts[filepath.Ext(base)]; ok {
+		return ft.Name, true
+	}
+	return "", false
+}
+
+// Content-Type header used when downloading the raw content of a paste,
+// viewing it in a browser always uses text/plain
+func rawContentType(filetype string) string {
+	mime := "text/plain"
+	if name, ok := normalizeFileType(filetype); ok {
+		mime = fileTypeNames[name].MIME
+	}
+	if activeMIME[mime] {
+		mime = "text/plain"
+	}
+	return mime + "; charset=utf-8"
+}
+
+// Filename a paste is downloaded as, its own or its UUID with an extension
+// for its filetype
+func downloadName(p *Paste) string {
+	if p.Filename != "" {
+		return filepath.Base(p.Filename)
+	}
+	ext := ".txt"
+	if name, ok := normalizeFileType(p.FileType); ok && len(fileTypeNames[name].Extensions) > 0 {
+		ext = fileTypeNames[name].Extensions[0]
+	}
+	return p.UUID + ext
+}
+
+/* GET /api/filetypes
+
+Returns the list of supported filetypes in JSON
+[
+	{
+		name:		String,
+		aliases:	[]String,
+		extensions:	[]String,
+		filenames:	[]String,
+		mime:		String
+	}
+]
+*/
+func (h *Handler) getFileTypes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(fileTypes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+)
+
+/* Security headers
+Every response gets headers telling browsers not to sniff content types,
+not to send paste URLs (which may hold keys or share links) as referrers,
+not to let other sites frame the page and, in TLS mode, to only use HTTPS.
+The default Content-Security-Policy allows nothing but inline styles, pages
+that need more (rendered markdown and the SPA) set their own.
+
+Raw content can be served from a separate origin given by raw-origin, such
+as https://usercontent.example.com pointing at the same server. Requests for
+/{uuid}/raw on the main origin are then redirected there and the raw origin
+serves nothing else, so content a browser might still run can't reach the
+main origin's cookies or pages. The origin is checked by EnableRawOrigin
+when the server starts.
+*/
+const (
+	defaultCSP string = "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+	rawCSP     string = "default-src 'none'; frame-ancestors 'none'; sandbox"
+	spaCSP     string = "default-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; object-src 'none'; frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+	hstsHeader string = "max-age=31536000; includeSubDomains"
+)
+
+func setSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", defaultCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cross-Origin-Opener-Policy", "same-origin")
+	if viper.GetBool("tls") {
+		w.Header().Set("Strict-Transport-Security", hstsHeader)
+	}
+}
+
+// Middleware adding the security headers to every response
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parse the configured raw-origin and serve raw content from it, does
+// nothing when raw-origin isn't set
+func (h *Handler) EnableRawOrigin() error {
+	origin := viper.GetString("raw-origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid raw-origin %q, must be an http or https URL", origin)
+	}
+
+	h.rawOrigin = u
+	log.Print("info", "serving raw content from %s", u.Host)
+	return nil
+}
+
+// Middleware keeping raw content and everything else on their own origins
+func (h *Handler) separateRawOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := h.rawOrigin
+		if origin == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		raw := false
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ := route.GetPathTemplate()
+			raw = tmpl == "/{uuid}/raw"
+		}
+		onRawOrigin := h.onRawOrigin(r)
+
+		switch {
+		case raw && !onRawOrigin:
+			target := url.URL{
+				Scheme:   origin.Scheme,
+				Host:     origin.Host,
+				Path:     r.URL.Path,
+				RawQuery: h.rawOriginQuery(r),
+			}
+			http.Redirect(w, r, target.String(), http.StatusFound)
+		case !raw && onRawOrigin:
+			http.NotFound(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Sent when a route exists but not for the request's method
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+// Whether the request was made to the raw origin
+func (h *Handler) onRawOrigin(r *http.Request) bool {
+	return h.rawOrigin != nil && strings.EqualFold(r.Host, h.rawOrigin.Host)
+}
+
+// How long the share link added when redirecting to the raw origin lasts
+const rawShareTTL = 5 * time.Minute
+
+/* Raw origin query
+Session cookies aren't sent to the raw origin, so with require-auth-read a
+signed in user redirected there would be turned away. When the request has
+no key or share link of its own a short-lived raw share link is added to the
+redirect, only for pastes the user can read.
+*/
+func (h *Handler) rawOriginQuery(r *http.Request) string {
+	query := r.URL.Query()
+	if !viper.GetBool(authRead) || requestUser(r) == nil ||
+		requestKey(r) != "" || query.Get("share") != "" {
+		return r.URL.RawQuery
+	}
+
+	uuidStr, _ := mux.Vars(r)["uuid"]
+	paste, err := h.findReadablePaste(r, uuidStr)
+	if err != nil {
+		return r.URL.RawQuery
+	}
+	expiresAt := time.Now().Add(rawShareTTL)
+	if pasteExpiry := paste.ExpiresAt.Time(); pasteExpiry.Before(expiresAt) {
+		expiresAt = pasteExpiry
+	}
+	share, err := paste.signShare(shareRaw, expiresAt)
+	if err != nil {
+		log.Print("error", "signing raw share link: %v", err)
+		return r.URL.RawQuery
+	}
+	query.Set("share", share)
+	return query.Encode()
+}
@@ -0,0 +1,459 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* Capability keys
+A paste's access key is its owner key and grants every right. The owner can
+also issue any number of read keys, which allow reading a private paste,
+and edit keys, which additionally allow updating it but not deleting it or
+changing its visibility. Issued keys are stored hashed and can be revoked
+one at a time.
+
+Pastes created with "private": true can only be read with a key (or by
+their owner) so the UUID alone is no longer enough, a read key is issued
+when the paste is created. Keys are sent with reads as the "key" query
+parameter (making a shareable link) or the X-Paste-Key header, and in the
+"accessKey" field of the body for updates.
+*/
+const (
+	roleRead  string = "read"
+	roleEdit  string = "edit"
+	roleOwner string = "owner"
+
+	pasteKeyLength int = 32
+	maxPasteKeys   int = 50
+)
+
+var errKeyNotFound = errors.New("No key found with that ID")
+
+type pasteKey struct {
+	ID        string             `json:"id" bson:"id"`
+	Hash      string             `json:"-" bson:"hash"`
+	Role      string             `json:"role" bson:"role"`
+	CreatedAt primitive.DateTime `json:"createdAt" bson:"createdAt"`
+}
+
+// Issue a new key with the given role, returning the key itself which is
+// never stored
+func (p *Paste) issueKey(role string) (string, *pasteKey, error) {
+	if role != roleRead && role != roleEdit {
+		return "", nil, fmt.Errorf("Invalid key role: %s", role)
+	}
+	key, err := secureRandomString(pasteKeyLength)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pk := &pasteKey{
+		ID:        uuid.New().String(),
+		Hash:      hashToken(key),
+		Role:      role,
+		CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+	}
+	p.Keys = append(p.Keys, *pk)
+	return key, pk, nil
+}
+
+// The rights the request has over the paste given the key it sent, empty if
+// it has none beyond what anyone has
+func (p *Paste) role(r *http.Request, key string) string {
+	if canModify(r, p, key) {
+		return roleOwner
+	}
+	if key == "" {
+		return ""
+	}
+	hash := hashToken(key)
+	for _, pk := range p.Keys {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(pk.Hash)) == 1 {
+			return pk.Role
+		}
+	}
+	return ""
+}
+
+// Key sent with a read request
+func requestKey(r *http.Request) string {
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key
+	}
+	return r.Header.Get("X-Paste-Key")
+}
+
+// Whether the request can read the paste, anyone can read pastes that
+// aren't private
+func canRead(r *http.Request, p *Paste) bool {
+	return !p.Private || p.role(r, requestKey(r)) != "" || validShare(r, p)
+}
+
+// Fetch the paste for a read request, private pastes the request can't read
+// are treated as if they don't exist and only admins can read hidden ones
+func (h *Handler) findReadablePaste(r *http.Request, uuidStr string) (*Paste, error) {
+	paste, err := h.findPaste(r.Context(), uuidStr)
+	if err != nil {
+		return nil, err
+	}
+	if !canRead(r, paste) {
+		return nil, errPasteNotFound
+	}
+	if paste.Hidden && !isAdmin(r) {
+		return nil, errPasteHidden
+	}
+	return paste, nil
+}
+
+/* Like requireAuth for routes reading a single paste, which can also be
+read without signing in with one of its keys or a share link for it
+*/
+func (h *Handler) requireAuthOrGrant(policy string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if viper.GetBool(policy) && requestUser(r) == nil && !h.hasGrant(r) {
+			h.unauthorized(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Whether the request carries a key or share link for the paste in its URL
+func (h *Handler) hasGrant(r *http.Request) bool {
+	if requestKey(r) == "" && r.URL.Query().Get("share") == "" {
+		return false
+	}
+	uuidStr, _ := mux.Vars(r)["uuid"]
+	paste, err := h.findPaste(r.Context(), uuidStr)
+	if err != nil {
+		return false
+	}
+	return paste.role(r, requestKey(r)) != "" || validShare(r, paste)
+}
+
+// Load the paste for managing its keys, only its owner may do so
+func (h *Handler) loadOwnedPaste(w http.ResponseWriter, r *http.Request, key string) *Paste {
+	uuidStr, _ := mux.Vars(r)["uuid"]
+	paste, err := h.loadPaste(r.Context(), uuidStr)
+	if err != nil {
+		if err == errPasteNotFound {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !canModify(r, paste, key) {
+		http.Error(w, "Invalid access key", http.StatusUnauthorized)
+		return nil
+	}
+	return paste
+}
+
+/* POST /api/{uuid}/rotate-key
+r.Body:
+	"accessKey"  -> required (unless authenticated as the paste's owner)
+	"revokeKeys" -> optional (also revoke every read and edit key)
+
+Replaces the paste's access key with a newly generated one, the old key
+stops working straight away. Returns a JSON document
+{
+	uuid:		UUID,
+	accessKey:	String
+}
+The new key is only ever returned here
+*/
+func (h *Handler) rotateKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		// Load body into struct
+		body := struct {
+			AccessKey  string `json:"accessKey,omitempty"`
+			RevokeKeys bool   `json:"revokeKeys,omitempty"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		paste := h.loadOwnedPaste(w, r, body.AccessKey)
+		if paste == nil {
+			return
+		}
+
+		accessKey, err := secureRandomString(25)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Only replace the key that was checked, two rotations racing each
+		// other mustn't both succeed
+		filter := bson.M{"uuid": paste.UUID, "accessKey": paste.AccessKey}
+		update := bson.M{"$set": bson.M{"accessKey": accessKey}}
+		if body.RevokeKeys {
+			update["$unset"] = bson.M{"keys": ""}
+		}
+		res, err := h.pastes().UpdateOne(r.Context(), filter, update)
+		h.cache.remove(paste.UUID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if res.MatchedCount == 0 {
+			http.Error(w, "Access key has been changed since it was checked", http.StatusConflict)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["uuid"] = paste.UUID
+		response["accessKey"] = accessKey
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* POST /api/{uuid}/keys
+r.Body:
+	"accessKey" -> required (unless authenticated as the paste's owner)
+	"role"      -> required ("read" or "edit")
+
+Issues a new key for the paste and returns a JSON document
+{
+	id:		String,
+	key:		String,
+	role:		String,
+	createdAt:	Date
+}
+The key is only ever returned here
+*/
+func (h *Handler) createKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		// Load body into struct
+		body := struct {
+			AccessKey string `json:"accessKey,omitempty"`
+			Role      string `json:"role"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		paste := h.loadOwnedPaste(w, r, body.AccessKey)
+		if paste == nil {
+			return
+		}
+		if len(paste.Keys) >= maxPasteKeys {
+			http.Error(w, fmt.Sprintf("Paste already has %d keys", maxPasteKeys), http.StatusBadRequest)
+			return
+		}
+
+		key, pk, err := paste.issueKey(body.Role)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		update := bson.M{"$push": bson.M{"keys": pk}}
+		if _, err := h.pastes().UpdateOne(r.Context(), bson.M{"uuid": paste.UUID}, update); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.cache.remove(paste.UUID)
+
+		response := make(map[string]interface{})
+		response["id"] = pk.ID
+		response["key"] = key
+		response["role"] = pk.Role
+		response["createdAt"] = pk.CreatedAt.Time().String()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* GET /api/{uuid}/keys
+Headers:
+	"X-Paste-Key" -> required (unless authenticated as the paste's owner)
+
+Returns the keys issued for the paste in JSON
+{
+	keys: [{ id: String, role: String, createdAt: Date }]
+}
+*/
+func (h *Handler) getKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		paste := h.loadOwnedPaste(w, r, r.Header.Get("X-Paste-Key"))
+		if paste == nil {
+			return
+		}
+
+		keys := paste.Keys
+		if keys == nil {
+			keys = []pasteKey{}
+		}
+		response := make(map[string]interface{})
+		response["keys"] = keys
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* DELETE /api/{uuid}/keys/{id}
+r.Body:
+	"accessKey" -> required (unless authenticated as the paste's owner)
+
+Revokes a key issued for the paste
+*/
+func (h *Handler) revokeKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		id, _ := mux.Vars(r)["id"]
+
+		// Load body into struct
+		body := struct {
+			AccessKey string `json:"accessKey,omitempty"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		paste := h.loadOwnedPaste(w, r, body.AccessKey)
+		if paste == nil {
+			return
+		}
+
+		var revoked *pasteKey
+		for i := range paste.Keys {
+			if paste.Keys[i].ID == id {
+				revoked = &paste.Keys[i]
+			}
+		}
+		if revoked == nil {
+			http.Error(w, errKeyNotFound.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Pull the key exactly as stored so a key issued in the meantime is
+		// left alone
+		update := bson.M{"$pull": bson.M{"keys": revoked}}
+		res, err := h.pastes().UpdateOne(r.Context(), bson.M{"uuid": paste.UUID}, update)
+		h.cache.remove(paste.UUID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if res.ModifiedCount == 0 {
+			http.Error(w, errKeyNotFound.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIssueKey(t *testing.T) {
+	tests := []struct {
+		role    string
+		wantErr bool
+	}{
+		{roleRead, false},
+		{roleEdit, false},
+		{roleOwner, true},
+		{"admin", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			p := testPaste("d3b07384-d9a0-4c9b-8f3e-1a2b3c4d5e6f")
+			key, pk, err := p.issueKey(tt.role)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("issueKey(%q) error = %v, wantErr %v", tt.role, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(p.Keys) != 0 {
+					t.Errorf("key stored for invalid role")
+				}
+				return
+			}
+			if len(key) != pasteKeyLength || pk.Hash != hashToken(key) || pk.Role != tt.role {
+				t.Errorf("issueKey(%q) = %q, %+v", tt.role, key, pk)
+			}
+			if len(p.Keys) != 1 || p.Keys[0].Hash == key {
+				t.Errorf("stored keys = %+v, want one hashed key", p.Keys)
+			}
+		})
+	}
+}
+
+func TestPasteRole(t *testing.T) {
+	p := testPaste("6f1e2d3c-4b5a-4968-8776-655443322110")
+	p.Owner = "alice"
+	readKey, _, err := p.issueKey(roleRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editKey, _, err := p.issueKey(roleEdit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *User
+		key  string
+		want string
+	}{
+		{"no key", nil, "", ""},
+		{"access key", nil, p.AccessKey, roleOwner},
+		{"read key", nil, readKey, roleRead},
+		{"edit key", nil, editKey, roleEdit},
+		{"unknown key", nil, "not-a-key", ""},
+		{"key hash", nil, hashToken(readKey), ""},
+		{"owner", &User{Username: "alice"}, "", roleOwner},
+		{"admin", &User{Username: "root", Admin: true}, "", roleOwner},
+		{"other user", &User{Username: "bob"}, "", ""},
+		{"other user with read key", &User{Username: "bob"}, readKey, roleRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			}
+			if got := p.role(r, tt.key); got != tt.want {
+				t.Errorf("role() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanRead(t *testing.T) {
+	private := testPaste("0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", "secret")
+	private.Private = true
+	readKey, _, err := private.issueKey(roleRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := testPaste("1b2c3d4e-5f6a-4b7c-9d8e-0f1a2b3c4d5e", "hello")
+
+	tests := []struct {
+		name   string
+		paste  *Paste
+		target string
+		header string
+		want   bool
+	}{
+		{"public", public, "/", "", true},
+		{"private without key", private, "/", "", false},
+		{"private with query key", private, "/?key=" + readKey, "", true},
+		{"private with header key", private, "/", readKey, true},
+		{"private with wrong key", private, "/?key=nope", "", false},
+		{"query key wins", private, "/?key=nope", readKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("X-Paste-Key", tt.header)
+			}
+			if got := canRead(r, tt.paste); got != tt.want {
+				t.Errorf("canRead() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotateAndRevokeKeys(t *testing.T) {
+	setConfig(t, "max-size", 1)
+	h := NewHandler()
+	testDatabase(t, h)
+
+	var created struct {
+		UUID      string `json:"uuid"`
+		AccessKey string `json:"accessKey"`
+		ReadKey   string `json:"readKey"`
+	}
+	if code := serveJSON(t, h, http.MethodPost, "/api/new",
+		`{"content":["hello"],"filetype":"text","private":true}`, &created); code != http.StatusCreated {
+		t.Fatalf("creating paste: status = %d", code)
+	}
+	api := "/api/" + created.UUID
+	accessKey := created.AccessKey
+
+	var edit struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	body := `{"accessKey":"` + accessKey + `","role":"edit"}`
+	if code := serveJSON(t, h, http.MethodPost, api+"/keys", body, &edit); code != http.StatusCreated {
+		t.Fatalf("issuing edit key: status = %d", code)
+	}
+
+	// Each step runs against the paste as left by the ones before it
+	steps := []struct {
+		name string
+		run  func() int
+		want int
+	}{
+		{"rotate with read key", func() int {
+			return serveJSON(t, h, http.MethodPost, api+"/rotate-key", `{"accessKey":"`+created.ReadKey+`"}`, nil)
+		}, http.StatusUnauthorized},
+		{"rotate with edit key", func() int {
+			return serveJSON(t, h, http.MethodPost, api+"/rotate-key", `{"accessKey":"`+edit.Key+`"}`, nil)
+		}, http.StatusUnauthorized},
+		{"rotate", func() int {
+			old := accessKey
+			var rotated struct {
+				AccessKey string `json:"accessKey"`
+			}
+			code := serveJSON(t, h, http.MethodPost, api+"/rotate-key", `{"accessKey":"`+old+`"}`, &rotated)
+			if rotated.AccessKey == "" || rotated.AccessKey == old {
+				t.Errorf("rotated key = %q", rotated.AccessKey)
+			}
+			accessKey = rotated.AccessKey
+			return code
+		}, http.StatusOK},
+		{"old key rejected", func() int {
+			return serveJSON(t, h, http.MethodPost, api+"/rotate-key", `{"accessKey":"`+created.AccessKey+`"}`, nil)
+		}, http.StatusUnauthorized},
+		{"read key survives rotation", func() int {
+			return serveTest(h, http.MethodGet, api+"?key="+created.ReadKey, nil).Code
+		}, http.StatusOK},
+		{"revoke edit key", func() int {
+			return serveJSON(t, h, http.MethodDelete, api+"/keys/"+edit.ID, `{"accessKey":"`+accessKey+`"}`, nil)
+		}, http.StatusNoContent},
+		{"revoked key can't read", func() int {
+			return serveTest(h, http.MethodGet, api+"?key="+edit.Key, nil).Code
+		}, http.StatusBadRequest},
+		{"revoke again", func() int {
+			return serveJSON(t, h, http.MethodDelete, api+"/keys/"+edit.ID, `{"accessKey":"`+accessKey+`"}`, nil)
+		}, http.StatusBadRequest},
+		{"rotate revoking keys", func() int {
+			var rotated struct {
+				AccessKey string `json:"accessKey"`
+			}
+			code := serveJSON(t, h, http.MethodPost, api+"/rotate-key",
+				`{"accessKey":"`+accessKey+`","revokeKeys":true}`, &rotated)
+			accessKey = rotated.AccessKey
+			return code
+		}, http.StatusOK},
+		{"read key revoked", func() int {
+			return serveTest(h, http.MethodGet, api+"?key="+created.ReadKey, nil).Code
+		}, http.StatusBadRequest},
+		{"new key reads", func() int {
+			return serveTest(h, http.MethodGet, api+"?key="+accessKey, nil).Code
+		}, http.StatusOK},
+	}
+	for _, step := range steps {
+		if got := step.run(); got != step.want {
+			t.Fatalf("%s: status = %d, want %d", step.name, got, step.want)
+		}
+	}
+}
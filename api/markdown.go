@@ -0,0 +1,235 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting"
+	"github.com/yuin/goldmark/extension"
+)
+
+const highlightStyle string = "github"
+
+/* Markdown rendering
+Pastes with the markdown filetype can be rendered into HTML, goldmark is
+used with the GFM extensions (tables, task lists, strikethrough and
+autolinks) and chroma for highlighting fenced code blocks.
+
+goldmark is left in its default safe mode so raw HTML is never passed
+through and dangerous link destinations are dropped, the output is then run
+through a bluemonday policy as a second line of defence. The page itself
+is served with a CSP forbidding all scripts.
+*/
+var (
+	markdown = goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			highlighting.NewHighlighting(
+				highlighting.WithStyle(highlightStyle),
+				highlighting.WithFormatOptions(
+					chromahtml.WithClasses(true),
+				),
+			),
+		),
+	)
+
+	markdownPolicy = newMarkdownPolicy()
+
+	// Chroma classes are all short lowercase identifiers
+	classPattern = regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)
+)
+
+func newMarkdownPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Allow the classes used for highlighting code blocks
+	p.AllowAttrs("class").Matching(classPattern).OnElements("pre", "code", "span")
+
+	// Allow the disabled checkboxes produced by GFM task lists
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+
+	return p
+}
+
+func isMarkdown(filetype string) bool {
+	ft, _ := normalizeFileType(filetype)
+	return ft == "markdown"
+}
+
+// Render markdown lines into sanitized HTML
+func renderMarkdown(content []string) (template.HTML, error) {
+	var buf bytes.Buffer
+	source := []byte(strings.Join(content, "\n"))
+	if err := markdown.Convert(source, &buf); err != nil {
+		return "", err
+	}
+
+	return template.HTML(markdownPolicy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// Stylesheet for the highlighting classes emitted by chroma
+func highlightCSS() template.CSS {
+	var buf bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.WriteCSS(&buf, styles.Get(highlightStyle)); err != nil {
+		log.Print("error", "%v", err)
+		return ""
+	}
+	return template.CSS(buf.String())
+}
+
+var renderedPage = template.Must(template.New("rendered").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ if .Title }}{{ .Title }}{{ else }}{{ .UUID }}{{ end }}</title>
+<style>
+body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: sans-serif; line-height: 1.5; }
+nav { font-size: 0.9em; border-bottom: 1px solid #ddd; padding-bottom: 0.5em; margin-bottom: 1em; }
+pre { padding: 0.5em; overflow-x: auto; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ddd; padding: 0.25em 0.5em; }
+li > input[type=checkbox] { margin-right: 0.5em; }
+.description { white-space: pre-wrap; color: #555; }
+{{ .CSS }}
+</style>
+</head>
+<body>
+<nav>
+{{ if .Title }}<strong>{{ .Title }}</strong> &middot;
+{{ end }}{{ if .Tags }}{{ range $i, $t := .Tags }}{{ if $i }}, {{ end }}{{ $t }}{{ end }} &middot;
+{{ end }}<a href="/{{ .UUID }}{{ if .Key }}?key={{ .Key }}{{ else if .Share }}?share={{ .Share }}{{ end }}">source</a> &middot;
+<a href="/{{ .UUID }}/raw{{ if .Key }}?key={{ .Key }}{{ else if .Share }}?share={{ .Share }}{{ end }}">raw</a> &middot;
+expires {{ .ExpiresAt }}
+</nav>
+{{ if .Description }}<p class="description">{{ .Description }}</p>
+{{ end }}<main>
+{{ .Body }}
+</main>
+</body>
+</html>
+`))
+
+/* GET /{uuid}/rendered
+Return the content of a markdown paste rendered as sanitized HTML
+*/
+func (h *Handler) getRenderedPasteHTML() http.HandlerFunc {
+	css := highlightCSS()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+
+		// Fetch document matching UUID from database
+		paste, err := h.findReadablePaste(r, uuidStr)
+		if err != nil {
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if checkNotModified(w, r, paste) {
+			return
+		}
+
+		if !isMarkdown(paste.FileType) {
+			http.Error(w, "Paste filetype is not markdown", http.StatusBadRequest)
+			return
+		}
+
+		body, err := renderMarkdown(paste.Content)
+		if err != nil {
+			log.Print("error", "%v", err)
+			http.Error(w, "Error rendering markdown", http.StatusInternalServerError)
+			return
+		}
+
+		// Scripts should never run on this page even if something slips
+		// through the sanitizer
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'none'; style-src 'unsafe-inline'; img-src * data:; frame-ancestors 'none'; base-uri 'none'; form-action 'none'")
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+
+		data := struct {
+			UUID        string
+			Key         string
+			Share       string
+			Title       string
+			Description string
+			Tags        []string
+			ExpiresAt   string
+			CSS         template.CSS
+			Body        template.HTML
+		}{
+			UUID:        uuidStr,
+			Key:         requestKey(r),
+			Share:       requestShare(r, paste),
+			Title:       paste.Title,
+			Description: paste.Description,
+			Tags:        paste.Tags,
+			ExpiresAt:   paste.ExpiresAt.Time().String(),
+			CSS:         css,
+			Body:        body,
+		}
+		if err := renderedPage.Execute(w, data); err != nil {
+			log.Print("error", "%v", err)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/h5law/paste-server/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Paste metadata
+Pastes can be given a title, description and tags so they are recognisable
+without reading their content. Tags are normalised to lowercase and a paste
+marked public is included in the listing at /api/pastes, pastes are never
+listed unless their creator asked for it.
+*/
+const (
+	maxTitleLength       int = 200
+	maxDescriptionLength int = 2000
+	maxTags              int = 10
+	maxTagLength         int = 32
+
+	defaultPageSize int = 20
+	maxPageSize     int = 100
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]*$`)
+
+// Lowercase, validate and remove duplicates from a list of tags
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("Invalid tag: %s", tag)
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("A paste can have at most %d tags", maxTags)
+	}
+	return normalized, nil
+}
+
+/* Apply the metadata fields given in the body to the paste, fields that
+aren't given are left as they are and empty ones clear the field. Nothing
+is changed if any of them are invalid.
+*/
+func (p *Paste) setMetadata(src *PasteBody) error {
+	title, description := p.Title, p.Description
+	if src.Title != nil {
+		title = strings.TrimSpace(*src.Title)
+		if len(title) > maxTitleLength || strings.ContainsAny(title, "\r\n") {
+			return fmt.Errorf("Title must be a single line of at most %d characters", maxTitleLength)
+		}
+	}
+	if src.Description != nil {
+		description = strings.TrimSpace(*src.Description)
+		if len(description) > maxDescriptionLength {
+			return fmt.Errorf("Description must not be longer than %d characters", maxDescriptionLength)
+		}
+	}
+	tags := p.Tags
+	if src.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(src.Tags); err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			tags = nil
+		}
+	}
+
+	public, private := p.Public, p.Private
+	if src.Public != nil {
+		public = *src.Public
+	}
+	if src.Private != nil {
+		private = *src.Private
+		// Making a paste private takes it out of the listing
+		if private && src.Public == nil {
+			public = false
+		}
+	}
+	if public && private {
+		return errors.New("A paste can't be both public and private")
+	}
+
+	p.Title = title
+	p.Description = description
+	p.Tags = tags
+	p.Public = public
+	p.Private = private
+	return nil
+}
+
+// Whether the body changes any of the metadata fields
+func (src *PasteBody) hasMetadata() bool {
+	return src.Title != nil || src.Description != nil || src.Tags != nil ||
+		src.Public != nil || src.Private != nil
+}
+
+// Only the fields needed for summaries are read for listings
+var summaryProjection = bson.M{
+	"_id":         0,
+	"uuid":        1,
+	"filetype":    1,
+	"filename":    1,
+	"title":       1,
+	"description": 1,
+	"tags":        1,
+	"size":        1,
+	"updatedAt":   1,
+	"expiresAt":   1,
+}
+
+// Fields of a paste shown in listings, everything but the content
+func (p *Paste) summary() map[string]interface{} {
+	summary := make(map[string]interface{})
+	summary["uuid"] = p.UUID
+	summary["filetype"] = p.FileType
+	summary["expiresAt"] = p.ExpiresAt.Time().String()
+	if p.Title != "" {
+		summary["title"] = p.Title
+	}
+	if p.Description != "" {
+		summary["description"] = p.Description
+	}
+	if len(p.Tags) > 0 {
+		summary["tags"] = p.Tags
+	}
+	if p.Filename != "" {
+		summary["filename"] = p.Filename
+	}
+	if p.UpdatedAt != 0 {
+		summary["updatedAt"] = p.UpdatedAt.Time().String()
+	}
+	if p.Size != 0 {
+		summary["size"] = p.Size
+	}
+	return summary
+}
+
+// Parse the 1-based page and page size query parameters
+func parsePage(q url.Values) (int, int, error) {
+	page, limit := 1, defaultPageSize
+	if s := q.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, fmt.Errorf("Invalid page: %s", s)
+		}
+		page = n
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageSize {
+			return 0, 0, fmt.Errorf("Limit must be between 1 and %d", maxPageSize)
+		}
+		limit = n
+	}
+	return page, limit, nil
+}
+
+/* GET /api/pastes
+Query:
+	"tag"   -> optional (only pastes with this tag)
+	"page"  -> optional (1-based, defaults to 1)
+	"limit" -> optional (pastes per page, 1-100 defaults to 20)
+
+Returns the public pastes, most recently updated first, in JSON
+{
+	pastes:	[{ uuid: UUID, title: String, description: String, tags: []String,
+		filetype: String, filename: String, size: Number,
+		updatedAt: Date, expiresAt: Date }],
+	page:	Number,
+	limit:	Number,
+	total:	Number
+}
+*/
+func (h *Handler) listPastes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		q := r.URL.Query()
+		page, limit, err := parsePage(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Expired pastes may not have been removed by the TTL index yet
+		filter := bson.M{
+			"public":    true,
+			"hidden":    bson.M{"$ne": true},
+			"expiresAt": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+		}
+		if tag := q.Get("tag"); tag != "" {
+			tags, err := normalizeTags([]string{tag})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter["tags"] = tags[0]
+		}
+
+		total, err := h.pastes().CountDocuments(r.Context(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		opts := options.Find().
+			SetProjection(summaryProjection).
+			SetSort(bson.D{{Key: "updatedAt", Value: -1}}).
+			SetSkip(int64((page - 1) * limit)).
+			SetLimit(int64(limit))
+		cursor, err := h.pastes().Find(r.Context(), filter, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var pastes []Paste
+		if err := cursor.All(r.Context(), &pastes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		summaries := make([]map[string]interface{}, 0, len(pastes))
+		for i := range pastes {
+			summaries = append(summaries, pastes[i].summary())
+		}
+
+		response := make(map[string]interface{})
+		response["pastes"] = summaries
+		response["page"] = page
+		response["limit"] = limit
+		response["total"] = total
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
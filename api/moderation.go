@@ -0,0 +1,435 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Moderation
+Anyone who can read a paste can report it, each reporter (an account or an
+IP address) has at most one report per paste and reporting again replaces
+it. Reported pastes wait in a queue for an admin to hide, delete or dismiss
+their reports, through the moderate subcommand or GET /api/reports and
+POST /api/reports/{uuid}. Until then they are served with no-store so
+caches don't keep serving them once they are hidden.
+
+Hidden pastes stay in the database but every read handler responds with 451
+Unavailable For Legal Reasons, except to admins, and they are left out of
+listings and search. Pastes are hidden until a moderator unhides them.
+*/
+const (
+	reportCollName string = "reports"
+
+	maxReportDetails int = 1000
+)
+
+var (
+	reportReasons     = []string{"spam", "malware", "phishing", "illegal", "copyright", "personal-data", "other"}
+	moderationActions = []string{"hide", "unhide", "delete", "dismiss"}
+
+	errPasteHidden = errors.New("Paste has been hidden by a moderator")
+)
+
+type Report struct {
+	Paste     string             `json:"paste" bson:"paste"`
+	Reporter  string             `json:"-" bson:"reporter"`
+	Reason    string             `json:"reason" bson:"reason"`
+	Details   string             `json:"details,omitempty" bson:"details,omitempty"`
+	CreatedAt primitive.DateTime `json:"createdAt" bson:"createdAt"`
+	ExpiresAt primitive.DateTime `json:"-" bson:"expiresAt"`
+}
+
+type ReportBody struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details,omitempty"`
+}
+
+type ModerateBody struct {
+	Action string `json:"action"`
+}
+
+// A paste waiting for moderation along with its reports, oldest first
+type ReportedPaste struct {
+	UUID    string   `json:"uuid"`
+	Reports []Report `json:"reports"`
+}
+
+func (h *Handler) reports() *mongo.Collection {
+	return h.database().Collection(reportCollName)
+}
+
+func isAdmin(r *http.Request) bool {
+	user := requestUser(r)
+	return user != nil && user.Admin
+}
+
+func validReason(reason string) bool {
+	for _, valid := range reportReasons {
+		if reason == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Reported pastes in the order they were first reported
+func (h *Handler) ReportQueue(ctx context.Context) ([]ReportedPaste, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	cursor, err := h.reports().Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var reports []Report
+	if err := cursor.All(ctx, &reports); err != nil {
+		return nil, err
+	}
+
+	queue := []ReportedPaste{}
+	index := make(map[string]int)
+	for _, report := range reports {
+		i, ok := index[report.Paste]
+		if !ok {
+			i = len(queue)
+			index[report.Paste] = i
+			queue = append(queue, ReportedPaste{UUID: report.Paste})
+		}
+		queue[i].Reports = append(queue[i].Reports, report)
+	}
+	return queue, nil
+}
+
+// Remove the paste's reports, returning how many there were
+func (h *Handler) DismissReports(ctx context.Context, uuidStr string) (int64, error) {
+	res, err := h.reports().DeleteMany(ctx, bson.M{"paste": uuidStr})
+	if err != nil {
+		return 0, err
+	}
+	update := bson.M{"$unset": bson.M{"reported": ""}}
+	if _, err := h.pastes().UpdateOne(ctx, bson.M{"uuid": uuidStr}, update); err != nil {
+		return 0, err
+	}
+	h.cache.remove(uuidStr)
+	return res.DeletedCount, nil
+}
+
+/* Hide or unhide the paste, hiding it resolves its reports. When called
+from the moderate subcommand a running server may keep serving a paste it
+has cached for up to cache-ttl seconds after it is hidden, the HTTP
+endpoint doesn't have that delay
+*/
+func (h *Handler) HidePaste(ctx context.Context, uuidStr string, hidden bool) error {
+	update := bson.M{"$set": bson.M{"hidden": true}}
+	if !hidden {
+		update = bson.M{"$unset": bson.M{"hidden": ""}}
+	}
+	res, err := h.pastes().UpdateOne(ctx, bson.M{"uuid": uuidStr}, update)
+	h.cache.remove(uuidStr)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errPasteNotFound
+	}
+
+	if hidden {
+		log.Print("info", "paste %s hidden by moderator", uuidStr)
+		_, err = h.DismissReports(ctx, uuidStr)
+	} else {
+		log.Print("info", "paste %s unhidden by moderator", uuidStr)
+	}
+	return err
+}
+
+// Delete the paste along with its comments and reports
+func (h *Handler) RemovePaste(ctx context.Context, uuidStr string) error {
+	paste, err := h.loadPaste(ctx, uuidStr)
+	if err != nil {
+		return err
+	}
+	res, err := h.pastes().DeleteOne(ctx, bson.M{"uuid": uuidStr})
+	h.cache.remove(uuidStr)
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errPasteNotFound
+	}
+	if paste.ContentHash != "" {
+		h.dropBlobRef(paste.ContentHash)
+	}
+	h.deleteComments(ctx, uuidStr)
+	h.addUsage(-int64(contentSize(paste.Content)), -1)
+	log.Print("info", "paste %s deleted by moderator", uuidStr)
+
+	_, err = h.DismissReports(ctx, uuidStr)
+	return err
+}
+
+/* POST /api/{uuid}/report
+r.Body:
+	"reason"  -> required (spam, malware, phishing, illegal, copyright,
+	             personal-data or other)
+	"details" -> optional (up to 1000 characters)
+
+Reports the paste to the moderators and returns a JSON document
+{
+	uuid:	UUID,
+	reason:	String
+}
+*/
+func (h *Handler) reportPaste() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+
+		// Load body into struct
+		var body ReportBody
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if !validReason(body.Reason) {
+			http.Error(w, fmt.Sprintf("Invalid reason, must be one of: %s", strings.Join(reportReasons, ", ")), http.StatusBadRequest)
+			return
+		}
+		body.Details = strings.TrimSpace(body.Details)
+		if len([]rune(body.Details)) > maxReportDetails {
+			http.Error(w, fmt.Sprintf("Details must be at most %d characters", maxReportDetails), http.StatusBadRequest)
+			return
+		}
+
+		paste, err := h.findReadablePaste(r, uuidStr)
+		if err != nil {
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reporter := "ip:" + h.clientHash(r)
+		if user := requestUser(r); user != nil {
+			reporter = "user:" + user.Username
+		}
+
+		// Reports go when the paste expires
+		report := Report{
+			Paste:     paste.UUID,
+			Reporter:  reporter,
+			Reason:    body.Reason,
+			Details:   body.Details,
+			CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+			ExpiresAt: paste.ExpiresAt,
+		}
+		filter := bson.M{"paste": paste.UUID, "reporter": reporter}
+		opts := options.Replace().SetUpsert(true)
+		if _, err := h.reports().ReplaceOne(r.Context(), filter, report, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		update := bson.M{"$set": bson.M{"reported": true}}
+		_, err = h.pastes().UpdateOne(r.Context(), bson.M{"uuid": paste.UUID}, update)
+		h.cache.remove(paste.UUID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Print("warn", "paste %s reported for %s", paste.UUID, body.Reason)
+
+		response := make(map[string]interface{})
+		response["uuid"] = paste.UUID
+		response["reason"] = body.Reason
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* GET /api/reports
+Admins only. Returns the moderation queue as a JSON document
+{
+	pastes: [{ uuid: UUID, reports: [{ reason: String, details: String, createdAt: Date }, ...] }, ...]
+}
+*/
+func (h *Handler) getReports() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		if requestUser(r) == nil {
+			h.unauthorized(w, r)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "Only admins can view reports", http.StatusForbidden)
+			return
+		}
+
+		queue, err := h.ReportQueue(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["pastes"] = queue
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* POST /api/reports/{uuid}
+r.Body:
+	"action"  -> required (hide, unhide, delete or dismiss)
+
+Admins only. Hides, unhides or deletes the paste or dismisses its reports
+as the moderate subcommand does, the server's cached copy is dropped
+straight away. Returns a JSON document
+{
+	uuid:	UUID,
+	action:	String
+}
+*/
+func (h *Handler) moderatePaste() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		if requestUser(r) == nil {
+			h.unauthorized(w, r)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "Only admins can moderate pastes", http.StatusForbidden)
+			return
+		}
+
+		uuidStr, _ := mux.Vars(r)["uuid"]
+
+		// Load body into struct
+		var body ModerateBody
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var err error
+		switch body.Action {
+		case "hide", "unhide":
+			err = h.HidePaste(r.Context(), uuidStr, body.Action == "hide")
+		case "delete":
+			err = h.RemovePaste(r.Context(), uuidStr)
+		case "dismiss":
+			_, err = h.DismissReports(r.Context(), uuidStr)
+		default:
+			http.Error(w, fmt.Sprintf("Invalid action, must be one of: %s", strings.Join(moderationActions, ", ")), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["uuid"] = uuidStr
+		response["action"] = body.Action
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
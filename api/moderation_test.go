@@ -0,0 +1,210 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestValidReason(t *testing.T) {
+	tests := []struct {
+		reason string
+		want   bool
+	}{
+		{"spam", true},
+		{"personal-data", true},
+		{"other", true},
+		{"Spam", false},
+		{"rude", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validReason(tt.reason); got != tt.want {
+			t.Errorf("validReason(%q) = %v, want %v", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func TestModeratePasteChecks(t *testing.T) {
+	setConfig(t, "max-size", 1)
+	tests := []struct {
+		name string
+		user *User
+		body string
+		want int
+	}{
+		{"anonymous", nil, `{"action":"hide"}`, http.StatusUnauthorized},
+		{"not an admin", &User{Username: "alice"}, `{"action":"hide"}`, http.StatusForbidden},
+		{"unknown action", &User{Username: "root", Admin: true}, `{"action":"ban"}`, http.StatusBadRequest},
+		{"no action", &User{Username: "root", Admin: true}, `{}`, http.StatusBadRequest},
+		{"bad body", &User{Username: "root", Admin: true}, `{"action":`, http.StatusBadRequest},
+	}
+	h := &Handler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/reports/x", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			r = mux.SetURLVars(r, map[string]string{"uuid": "x"})
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			}
+			w := httptest.NewRecorder()
+			h.moderatePaste()(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestModeratedReads(t *testing.T) {
+	plain := testPaste("5a6b7c8d-9e0f-4a1b-8c2d-3e4f5a6b7c8d", "content")
+	reported := testPaste("6b7c8d9e-0f1a-4b2c-9d3e-4f5a6b7c8d9e", "content")
+	reported.Reported = true
+	hidden := testPaste("7c8d9e0f-1a2b-4c3d-8e4f-5a6b7c8d9e0f", "content")
+	hidden.Hidden = true
+	h := newTestHandler(t, plain, reported, hidden)
+
+	tests := []struct {
+		name        string
+		paste       *Paste
+		wantCode    int
+		wantNoStore bool
+	}{
+		{"plain", plain, http.StatusOK, false},
+		{"reported", reported, http.StatusOK, true},
+		{"hidden", hidden, http.StatusUnavailableForLegalReasons, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(h, http.MethodGet, "/"+tt.paste.UUID+"/raw", nil)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			noStore := w.Header().Get("Cache-Control") == "no-store"
+			if tt.wantCode == http.StatusOK && noStore != tt.wantNoStore {
+				t.Errorf("Cache-Control = %q", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestModerationQueue(t *testing.T) {
+	setConfig(t, "max-size", 1)
+	h := NewHandler()
+	testDatabase(t, h)
+	ctx := context.Background()
+
+	var created struct {
+		UUID string `json:"uuid"`
+	}
+	if code := serveJSON(t, h, http.MethodPost, "/api/new", `{"content":["spam spam spam"],"filetype":"text"}`, &created); code != http.StatusCreated {
+		t.Fatalf("creating paste: status = %d", code)
+	}
+	uuid := created.UUID
+	report := func(remoteAddr, reason string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/"+uuid+"/report", strings.NewReader(`{"reason":"`+reason+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	queued := func() int {
+		queue, err := h.ReportQueue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reports := 0
+		for _, p := range queue {
+			if p.UUID == uuid {
+				reports += len(p.Reports)
+			}
+		}
+		return reports
+	}
+	read := func() int {
+		return serveTest(h, http.MethodGet, "/"+uuid+"/raw", nil).Code
+	}
+	check := func(err error) int {
+		switch err {
+		case nil:
+			return http.StatusOK
+		case errPasteNotFound:
+			return http.StatusNotFound
+		}
+		t.Fatal(err)
+		return 0
+	}
+
+	// Each step runs against the paste as left by the ones before it
+	steps := []struct {
+		name        string
+		run         func() int
+		wantCode    int
+		wantReports int
+		wantRead    int
+	}{
+		{"invalid reason", func() int { return report("192.0.2.1:1", "rude") }, http.StatusBadRequest, 0, http.StatusOK},
+		{"report", func() int { return report("192.0.2.1:1", "spam") }, http.StatusAccepted, 1, http.StatusOK},
+		{"report again replaces", func() int { return report("192.0.2.1:2", "malware") }, http.StatusAccepted, 1, http.StatusOK},
+		{"second reporter", func() int { return report("192.0.2.2:1", "spam") }, http.StatusAccepted, 2, http.StatusOK},
+		{"hide", func() int { return check(h.HidePaste(ctx, uuid, true)) }, http.StatusOK, 0, http.StatusUnavailableForLegalReasons},
+		{"report hidden", func() int { return report("192.0.2.3:1", "spam") }, http.StatusUnavailableForLegalReasons, 0, http.StatusUnavailableForLegalReasons},
+		{"unhide", func() int { return check(h.HidePaste(ctx, uuid, false)) }, http.StatusOK, 0, http.StatusOK},
+		{"reported after unhiding", func() int { return report("192.0.2.3:1", "spam") }, http.StatusAccepted, 1, http.StatusOK},
+		{"dismiss", func() int { return check(func() error { _, err := h.DismissReports(ctx, uuid); return err }()) }, http.StatusOK, 0, http.StatusOK},
+		{"report before delete", func() int { return report("192.0.2.4:1", "spam") }, http.StatusAccepted, 1, http.StatusOK},
+		{"delete", func() int { return check(h.RemovePaste(ctx, uuid)) }, http.StatusOK, 0, http.StatusBadRequest},
+		{"delete again", func() int { return check(h.RemovePaste(ctx, uuid)) }, http.StatusNotFound, 0, http.StatusBadRequest},
+		{"hide deleted", func() int { return check(h.HidePaste(ctx, uuid, true)) }, http.StatusNotFound, 0, http.StatusBadRequest},
+	}
+	for _, step := range steps {
+		if got := step.run(); got != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d", step.name, got, step.wantCode)
+		}
+		if got := queued(); got != step.wantReports {
+			t.Errorf("%s: %d reports queued, want %d", step.name, got, step.wantReports)
+		}
+		if got := read(); got != step.wantRead {
+			t.Errorf("%s: reading paste: status = %d, want %d", step.name, got, step.wantRead)
+		}
+	}
+	if h.usage.usage != (Usage{}) {
+		t.Errorf("usage after removal = %+v, want none", h.usage.usage)
+	}
+}
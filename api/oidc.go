@@ -0,0 +1,412 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/oauth2"
+)
+
+/* OpenID Connect
+When an issuer is configured users can sign in to the web UI through the
+identity provider with the authorization code flow (with PKCE), after which
+the server sets a signed session cookie. API clients can instead send an ID
+token issued to the configured client as a bearer token. Either way the
+user is identified by the issuer and the token's subject, claims the user
+can change such as preferred_username are never trusted. A login only acts
+as a local account (taking its admin flag and pastes) once an admin has
+linked the two with `user link`, either by subject or by an email address
+the provider has verified. Logins that aren't linked get a username made
+from a hash of the issuer and subject, which can't clash with local names.
+
+The session cookie is SameSite=Lax and every endpoint that changes state
+only accepts JSON bodies, so other sites can't make requests with it.
+*/
+const (
+	sessionCookie   string = "paste_session"
+	loginCookie     string = "paste_login"
+	sessionLifetime        = 24 * time.Hour
+	loginLifetime          = 10 * time.Minute
+)
+
+var errInvalidSession = errors.New("Invalid session")
+
+type oidcAuth struct {
+	verifier *oidc.IDTokenVerifier
+	config   oauth2.Config
+}
+
+// Who signed in, Email is only set when the provider has verified it
+type oidcIdentity struct {
+	Issuer  string `json:"i"`
+	Subject string `json:"s"`
+	Email   string `json:"m,omitempty"`
+}
+
+type session struct {
+	oidcIdentity
+	Expires int64 `json:"e"`
+}
+
+// State kept in a cookie between redirecting to the provider and the
+// callback
+type loginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Next     string `json:"r"`
+	Expires  int64  `json:"e"`
+}
+
+/* Discover the configured issuer and enable OIDC login, does nothing when
+oidc-issuer isn't set
+*/
+func (h *Handler) EnableOIDC(ctx context.Context) error {
+	issuer := viper.GetString("oidc-issuer")
+	if issuer == "" {
+		return nil
+	}
+	clientID := viper.GetString("oidc-client-id")
+	redirectURL := viper.GetString("oidc-redirect-url")
+	if clientID == "" || redirectURL == "" {
+		return errors.New("oidc-client-id and oidc-redirect-url must be set to use OpenID Connect")
+	}
+
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return fmt.Errorf("failed to discover issuer: %v", err)
+	}
+
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range strings.Fields(viper.GetString("oidc-scopes")) {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	h.oidc = &oidcAuth{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: viper.GetString("oidc-client-secret"),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectURL,
+			Scopes:       scopes,
+		},
+	}
+
+	log.Print("info", "OpenID Connect enabled with issuer %s", issuer)
+	return nil
+}
+
+// The identity in a verified ID token
+func tokenIdentity(token *oidc.IDToken) (oidcIdentity, error) {
+	if token.Subject == "" {
+		return oidcIdentity{}, errors.New("ID token has no subject")
+	}
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return oidcIdentity{}, err
+	}
+
+	id := oidcIdentity{Issuer: token.Issuer, Subject: token.Subject}
+	if claims.EmailVerified {
+		id.Email = strings.ToLower(claims.Email)
+	}
+	return id, nil
+}
+
+// Username of a login that isn't linked to a local account
+func oidcUsername(id oidcIdentity) string {
+	return "oidc:" + hashToken(id.Issuer + "\n" + id.Subject)[:20]
+}
+
+/* The user signed in through OIDC, the local account linked to the
+subject or to the verified email address if there is one
+*/
+func (h *Handler) oidcUser(ctx context.Context, id oidcIdentity) (*User, error) {
+	filters := []bson.M{{"oidcIssuer": id.Issuer, "oidcSubject": id.Subject}}
+	if id.Email != "" {
+		filters = append(filters, bson.M{"oidcIssuer": id.Issuer, "oidcEmail": id.Email})
+	}
+	for _, filter := range filters {
+		var user User
+		err := h.users().FindOne(ctx, filter).Decode(&user)
+		if err == nil {
+			return &user, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+	return &User{Username: oidcUsername(id)}, nil
+}
+
+func (h *Handler) verifyIDToken(ctx context.Context, raw string) (*User, error) {
+	token, err := h.oidc.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	id, err := tokenIdentity(token)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	return h.oidcUser(ctx, id)
+}
+
+func (h *Handler) sessionUser(r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+
+	var s session
+	payload, err := verifyValue(sessionCookie, cookie.Value)
+	if err != nil || json.Unmarshal(payload, &s) != nil || time.Now().Unix() > s.Expires || s.Subject == "" {
+		return nil, errInvalidSession
+	}
+	return h.oidcUser(r.Context(), s.oidcIdentity)
+}
+
+// Cookies are only marked secure when the server is reached over https
+func setCookie(w http.ResponseWriter, name, value string, lifetime time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(viper.GetString("oidc-redirect-url"), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+}
+
+// Only redirect back to paths on this server after logging in
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+/* GET /auth/login
+Query:
+	"next" -> optional (path to return to after logging in)
+
+Redirects to the identity provider to log in
+*/
+func (h *Handler) login() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		if h.oidc == nil {
+			http.Error(w, "OpenID Connect is not enabled", http.StatusNotFound)
+			return
+		}
+
+		state, err := secureRandomString(32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nonce, err := secureRandomString(32)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		ls := loginState{
+			State:    state,
+			Nonce:    nonce,
+			Verifier: oauth2.GenerateVerifier(),
+			Next:     localPath(r.URL.Query().Get("next")),
+			Expires:  time.Now().Add(loginLifetime).Unix(),
+		}
+		payload, err := json.Marshal(ls)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, loginCookie, signValue(loginCookie, payload), loginLifetime)
+
+		authURL := h.oidc.config.AuthCodeURL(state,
+			oidc.Nonce(nonce),
+			oauth2.S256ChallengeOption(ls.Verifier),
+		)
+		http.Redirect(w, r, authURL, http.StatusFound)
+	}
+}
+
+/* GET /auth/callback
+Completes a login started at /auth/login, sets the session cookie and
+redirects back to where the user started
+*/
+func (h *Handler) loginCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		if h.oidc == nil {
+			http.Error(w, "OpenID Connect is not enabled", http.StatusNotFound)
+			return
+		}
+
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			http.Error(w, fmt.Sprintf("Login failed: %s", e), http.StatusUnauthorized)
+			return
+		}
+
+		// The state must match the login this browser started
+		var ls loginState
+		cookie, err := r.Cookie(loginCookie)
+		if err != nil {
+			http.Error(w, "No login in progress", http.StatusBadRequest)
+			return
+		}
+		clearCookie(w, loginCookie)
+		payload, err := verifyValue(loginCookie, cookie.Value)
+		if err != nil || json.Unmarshal(payload, &ls) != nil ||
+			time.Now().Unix() > ls.Expires || q.Get("state") != ls.State {
+			http.Error(w, "Invalid login state", http.StatusBadRequest)
+			return
+		}
+
+		token, err := h.oidc.config.Exchange(r.Context(), q.Get("code"), oauth2.VerifierOption(ls.Verifier))
+		if err != nil {
+			log.Print("warn", "failed to exchange code: %v", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+		raw, ok := token.Extra("id_token").(string)
+		if !ok {
+			http.Error(w, "Login failed: no ID token", http.StatusUnauthorized)
+			return
+		}
+		idToken, err := h.oidc.verifier.Verify(r.Context(), raw)
+		if err != nil || idToken.Nonce != ls.Nonce {
+			log.Print("warn", "invalid ID token: %v", err)
+			http.Error(w, "Login failed", http.StatusUnauthorized)
+			return
+		}
+		id, err := tokenIdentity(idToken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		user, err := h.oidcUser(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		s := session{
+			oidcIdentity: id,
+			Expires:      time.Now().Add(sessionLifetime).Unix(),
+		}
+		payload, err = json.Marshal(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, sessionCookie, signValue(sessionCookie, payload), sessionLifetime)
+
+		log.Print("info", "%s logged in", user.Username)
+		http.Redirect(w, r, ls.Next, http.StatusFound)
+	}
+}
+
+/* POST /auth/logout
+Clears the session cookie
+*/
+func (h *Handler) logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		clearCookie(w, sessionCookie)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Send a request that needs authenticating to the login page if it came
+// from a browser and login is possible, otherwise reject it
+func (h *Handler) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if h.oidc != nil && r.Method == http.MethodGet && !h.onRawOrigin(r) &&
+		!strings.HasPrefix(r.URL.Path, "/api/") &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") {
+		next := url.QueryEscape(r.URL.RequestURI())
+		http.Redirect(w, r, "/auth/login?next="+next, http.StatusFound)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Authentication required", http.StatusUnauthorized)
+}
@@ -0,0 +1,414 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const testClientID = "paste-test"
+
+/* Mock OpenID Connect issuer
+Serves discovery, the JWKS and a token endpoint checking PKCE. Codes are
+registered by the test with the claims the ID token should carry, the
+authorization endpoint itself is never visited.
+*/
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	sync.Mutex
+	codes map[string]mockCode
+}
+
+type mockCode struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, codes: make(map[string]mockCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   b64(key.N.Bytes()),
+				"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.Lock()
+		code, ok := m.codes[r.Form.Get("code")]
+		delete(m.codes, r.Form.Get("code"))
+		m.Unlock()
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     m.sign(t, code.claims),
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+// Claims for an ID token from this issuer to the test client
+func (m *mockIssuer) claims(sub string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": m.URL,
+		"sub": sub,
+		"aud": testClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+/* Point the handler at a database of its own on the server given by
+PASTE_TEST_MONGO_URI, the test is skipped when that isn't set. The database
+is randomly named and dropped once the test is done.
+*/
+func testDatabase(t *testing.T, h *Handler) {
+	uri := os.Getenv("PASTE_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("PASTE_TEST_MONGO_URI not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(2*time.Second))
+	if err == nil {
+		err = client.Ping(ctx, nil)
+	}
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", uri, err)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		t.Fatal(err)
+	}
+	h.Client = client
+	h.db = "pastes_test_" + hex.EncodeToString(suffix)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		if err := h.database().Drop(ctx); err != nil {
+			t.Errorf("dropping %s: %v", h.db, err)
+		}
+		client.Disconnect(ctx)
+	})
+}
+
+func TestOIDC(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.Close()
+
+	for key, value := range map[string]string{
+		"secret":            "test secret",
+		"oidc-issuer":       issuer.URL,
+		"oidc-client-id":    testClientID,
+		"oidc-redirect-url": "http://paste.test/auth/callback",
+	} {
+		viper.Set(key, value)
+		defer viper.Set(key, "")
+	}
+
+	h := NewHandler()
+	testDatabase(t, h)
+	ctx := context.Background()
+	if err := h.EnableOIDC(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A local account to link logins to
+	username := "oidc-test-" + strings.ToLower(strings.ReplaceAll(time.Now().Format("150405.000000"), ".", ""))
+	if err := h.CreateUser(ctx, username, true); err != nil {
+		t.Fatal(err)
+	}
+	defer h.RemoveUser(ctx, username)
+	sub := "subject-" + username
+
+	serve := func(method, target string, header http.Header, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	cookie := func(w *httptest.ResponseRecorder, name string) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == name {
+				return c
+			}
+		}
+		return nil
+	}
+	me := func(header http.Header, cookies ...*http.Cookie) (int, string, bool) {
+		w := serve("GET", "/api/me", header, cookies...)
+		var body struct {
+			Username string `json:"username"`
+			Admin    bool   `json:"admin"`
+		}
+		json.NewDecoder(w.Body).Decode(&body)
+		return w.Code, body.Username, body.Admin
+	}
+	bearer := func(token string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	// Log in through the provider, returning the session cookie
+	login := func(t *testing.T, claims map[string]interface{}) *http.Cookie {
+		w := serve("GET", "/auth/login?next=/api/me", nil)
+		if w.Code != http.StatusFound {
+			t.Fatalf("login returned %d", w.Code)
+		}
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(loc.String(), issuer.URL+"/authorize") {
+			t.Fatalf("login redirected to %q", w.Header().Get("Location"))
+		}
+		q := loc.Query()
+		if q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+			t.Fatalf("authorization request missing client or PKCE: %v", q)
+		}
+		loginState := cookie(w, loginCookie)
+		if loginState == nil || !loginState.HttpOnly {
+			t.Fatal("login cookie not set")
+		}
+
+		claims["nonce"] = q.Get("nonce")
+		issuer.Lock()
+		issuer.codes["code-"+q.Get("state")] = mockCode{challenge: q.Get("code_challenge"), claims: claims}
+		issuer.Unlock()
+
+		callback := "/auth/callback?" + url.Values{"code": {"code-" + q.Get("state")}, "state": {q.Get("state")}}.Encode()
+		w = serve("GET", callback, nil, loginState)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/api/me" {
+			t.Fatalf("callback returned %d to %q: %s", w.Code, w.Header().Get("Location"), w.Body)
+		}
+		session := cookie(w, sessionCookie)
+		if session == nil || session.Value == "" || !session.HttpOnly || session.SameSite != http.SameSiteLaxMode {
+			t.Fatalf("session cookie not set: %+v", session)
+		}
+		return session
+	}
+
+	t.Run("unlinked login", func(t *testing.T) {
+		claims := issuer.claims(sub)
+		claims["preferred_username"] = username
+		session := login(t, claims)
+
+		code, name, admin := me(nil, session)
+		want := oidcUsername(oidcIdentity{Issuer: issuer.URL, Subject: sub})
+		if code != http.StatusOK || name != want || admin {
+			t.Errorf("/api/me = %d %q admin=%v, want %q without admin", code, name, admin, want)
+		}
+	})
+
+	t.Run("callback checks state", func(t *testing.T) {
+		w := serve("GET", "/auth/login", nil)
+		state := cookie(w, loginCookie)
+		w = serve("GET", "/auth/callback?code=x&state=wrong", nil, state)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("callback with wrong state returned %d", w.Code)
+		}
+		w = serve("GET", "/auth/callback?code=x&state=x", nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("callback without login cookie returned %d", w.Code)
+		}
+	})
+
+	t.Run("callback checks nonce", func(t *testing.T) {
+		w := serve("GET", "/auth/login", nil)
+		loc, _ := url.Parse(w.Header().Get("Location"))
+		state := loc.Query().Get("state")
+		claims := issuer.claims(sub)
+		claims["nonce"] = "replayed"
+		issuer.Lock()
+		issuer.codes["nonce-"+state] = mockCode{challenge: loc.Query().Get("code_challenge"), claims: claims}
+		issuer.Unlock()
+
+		w = serve("GET", "/auth/callback?code=nonce-"+state+"&state="+state, nil, cookie(w, loginCookie))
+		if w.Code != http.StatusUnauthorized || cookie(w, sessionCookie) != nil {
+			t.Errorf("callback with wrong nonce returned %d", w.Code)
+		}
+	})
+
+	t.Run("linked by subject", func(t *testing.T) {
+		if err := h.LinkUser(ctx, username, sub, ""); err != nil {
+			t.Fatal(err)
+		}
+		defer h.UnlinkUser(ctx, username)
+
+		session := login(t, issuer.claims(sub))
+		if code, name, admin := me(nil, session); code != http.StatusOK || name != username || !admin {
+			t.Errorf("/api/me = %d %q admin=%v, want %q as admin", code, name, admin, username)
+		}
+
+		// The session follows the link rather than remembering the account
+		h.UnlinkUser(ctx, username)
+		if _, name, _ := me(nil, session); name == username {
+			t.Error("session still acts as the unlinked account")
+		}
+	})
+
+	t.Run("linked by email", func(t *testing.T) {
+		email := username + "@example.com"
+		if err := h.LinkUser(ctx, username, "", strings.ToUpper(email)); err != nil {
+			t.Fatal(err)
+		}
+		defer h.UnlinkUser(ctx, username)
+
+		claims := issuer.claims("other-" + sub)
+		claims["email"] = email
+		if _, name, _ := me(bearer(issuer.sign(t, claims))); name == username {
+			t.Error("unverified email matched the linked account")
+		}
+		claims["email_verified"] = true
+		if _, name, _ := me(bearer(issuer.sign(t, claims))); name != username {
+			t.Errorf("verified email logged in as %q, want %q", name, username)
+		}
+	})
+
+	t.Run("bearer ID tokens", func(t *testing.T) {
+		want := oidcUsername(oidcIdentity{Issuer: issuer.URL, Subject: sub})
+		if code, name, _ := me(bearer(issuer.sign(t, issuer.claims(sub)))); code != http.StatusOK || name != want {
+			t.Errorf("valid token: /api/me = %d %q, want %q", code, name, want)
+		}
+
+		wrongAud := issuer.claims(sub)
+		wrongAud["aud"] = "someone-else"
+		expired := issuer.claims(sub)
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		noSub := issuer.claims("")
+		otherIssuer := issuer.claims(sub)
+		otherIssuer["iss"] = "https://evil.example.com"
+		valid := issuer.sign(t, issuer.claims(sub))
+
+		for name, token := range map[string]string{
+			"wrong audience": issuer.sign(t, wrongAud),
+			"expired":        issuer.sign(t, expired),
+			"no subject":     issuer.sign(t, noSub),
+			"other issuer":   issuer.sign(t, otherIssuer),
+			"tampered":       valid[:len(valid)-4] + "AAAA",
+			"garbage":        "not-a-token",
+		} {
+			w := serve("GET", "/api/me", bearer(token))
+			if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "invalid_token") {
+				t.Errorf("%s token returned %d", name, w.Code)
+			}
+		}
+	})
+
+	t.Run("bad session cookie", func(t *testing.T) {
+		w := serve("GET", "/api/me", nil, &http.Cookie{Name: sessionCookie, Value: "forged.value"})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("forged session returned %d", w.Code)
+		}
+		if c := cookie(w, sessionCookie); c == nil || c.MaxAge >= 0 {
+			t.Error("forged session cookie not cleared")
+		}
+	})
+
+	t.Run("logout", func(t *testing.T) {
+		w := serve("POST", "/auth/logout", nil)
+		if c := cookie(w, sessionCookie); w.Code != http.StatusNoContent || c == nil || c.MaxAge >= 0 {
+			t.Errorf("logout returned %d without clearing the session", w.Code)
+		}
+	})
+}
@@ -0,0 +1,260 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"math"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+)
+
+/* Proof of work
+When pow-difficulty is set anonymous clients must solve a hashcash style
+challenge before creating a paste. GET /api/challenge hands out a signed
+challenge and its difficulty, the client then searches for a counter such
+that
+	sha256(challenge + ":" + counter)
+starts with at least difficulty zero bits and sends
+	X-Paste-PoW: challenge:counter
+with POST /api/new. Challenges expire after powTTL and can only be used once.
+
+The difficulty goes up by a bit each time the rate of anonymous pastes
+doubles past pow-load per minute, up to pow-max-difficulty, so solving gets
+more expensive while the server is busy.
+*/
+const (
+	powTTL    time.Duration = 5 * time.Minute
+	powHeader string        = "X-Paste-PoW"
+)
+
+type powChallenge struct {
+	Nonce      string `json:"nonce"`
+	Difficulty int    `json:"difficulty"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// Spent challenges and the rate of anonymous pastes
+type powState struct {
+	sync.Mutex
+	used      map[string]time.Time
+	lastSweep time.Time
+	window    time.Time
+	count     int
+	previous  int
+}
+
+func newPowState() *powState {
+	return &powState{used: make(map[string]time.Time)}
+}
+
+// Anonymous pastes in the last minute, estimated from this and the previous
+// minute's counts
+func (s *powState) rate(now time.Time) float64 {
+	minute := now.Truncate(time.Minute)
+	if !minute.Equal(s.window) {
+		if minute.Sub(s.window) == time.Minute {
+			s.previous = s.count
+		} else {
+			s.previous = 0
+		}
+		s.window, s.count = minute, 0
+	}
+	elapsed := float64(now.Sub(minute)) / float64(time.Minute)
+	return float64(s.previous)*(1-elapsed) + float64(s.count)
+}
+
+// The difficulty to issue challenges at given the current load
+func (s *powState) difficulty(now time.Time) int {
+	base := viper.GetInt("pow-difficulty")
+	if base <= 0 {
+		return 0
+	}
+	max := viper.GetInt("pow-max-difficulty")
+	if max < base {
+		max = base
+	}
+
+	s.Lock()
+	rate := s.rate(now)
+	s.Unlock()
+
+	difficulty := base
+	if load := float64(viper.GetInt("pow-load")); load > 0 && rate > load {
+		difficulty += int(math.Log2(rate/load)) + 1
+	}
+	if difficulty > max {
+		difficulty = max
+	}
+	return difficulty
+}
+
+// Mark the challenge as spent, false if it already was
+func (s *powState) spend(challenge string, expiresAt, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastSweep) > time.Minute {
+		for c, exp := range s.used {
+			if now.After(exp) {
+				delete(s.used, c)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if _, ok := s.used[challenge]; ok {
+		return false
+	}
+	s.used[challenge] = expiresAt
+	s.rate(now)
+	s.count++
+	return true
+}
+
+// Number of leading zero bits of the hash
+func leadingZeros(hash []byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+/* Check the request solves a challenge when anonymous pastes need one,
+writing the error response and returning false if not
+*/
+func (h *Handler) checkProofOfWork(w http.ResponseWriter, r *http.Request) bool {
+	if viper.GetInt("pow-difficulty") <= 0 || requestUser(r) != nil {
+		return true
+	}
+
+	solution := r.Header.Get(powHeader)
+	if solution == "" {
+		http.Error(w, "Proof of work required, get a challenge from /api/challenge", http.StatusPreconditionRequired)
+		return false
+	}
+
+	invalid := func(msg string) bool {
+		http.Error(w, msg, http.StatusForbidden)
+		return false
+	}
+	idx := strings.LastIndex(solution, ":")
+	if idx < 0 {
+		return invalid("Invalid proof of work")
+	}
+	challenge := solution[:idx]
+	payload, err := verifyValue("pow", challenge)
+	if err != nil {
+		return invalid("Invalid proof of work")
+	}
+	var c powChallenge
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return invalid("Invalid proof of work")
+	}
+	now := time.Now()
+	expiresAt := time.Unix(c.ExpiresAt, 0)
+	if now.After(expiresAt) {
+		return invalid("Proof of work challenge has expired")
+	}
+
+	hash := sha256.Sum256([]byte(solution))
+	if leadingZeros(hash[:]) < c.Difficulty {
+		return invalid("Invalid proof of work")
+	}
+	if !h.pow.spend(challenge, expiresAt, now) {
+		return invalid("Proof of work challenge has already been used")
+	}
+	return true
+}
+
+/* GET /api/challenge
+Returns a proof of work challenge for creating a paste anonymously as a JSON
+document
+{
+	challenge:	String,
+	difficulty:	Number (leading zero bits, 0 when not required),
+	algorithm:	String,
+	expiresAt:	String
+}
+*/
+func (h *Handler) getChallenge() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		nonce, err := secureRandomString(22)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		expiresAt := time.Now().Add(powTTL)
+		c := powChallenge{
+			Nonce:      nonce,
+			Difficulty: h.pow.difficulty(time.Now()),
+			ExpiresAt:  expiresAt.Unix(),
+		}
+		payload, err := json.Marshal(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["challenge"] = signValue("pow", payload)
+		response["difficulty"] = c.Difficulty
+		response["algorithm"] = "sha256"
+		response["expiresAt"] = expiresAt.UTC().String()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
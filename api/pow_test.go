@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestLeadingZeros(t *testing.T) {
+	tests := []struct {
+		hash []byte
+		want int
+	}{
+		{[]byte{}, 0},
+		{[]byte{0x80}, 0},
+		{[]byte{0x7f}, 1},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00}, 8},
+		{[]byte{0x00, 0x00}, 16},
+		{[]byte{0x00, 0x10, 0xff}, 11},
+		{[]byte{0x00, 0x00, 0x00, 0x01}, 31},
+	}
+	for _, tt := range tests {
+		if got := leadingZeros(tt.hash); got != tt.want {
+			t.Errorf("leadingZeros(%x) = %d, want %d", tt.hash, got, tt.want)
+		}
+	}
+}
+
+func TestPowSpend(t *testing.T) {
+	s := newPowState()
+	now := time.Date(2026, 1, 1, 12, 0, 30, 0, time.UTC)
+	expiresAt := now.Add(powTTL)
+
+	if !s.spend("a", expiresAt, now) {
+		t.Fatal("first spend of a challenge refused")
+	}
+	if s.spend("a", expiresAt, now.Add(time.Second)) {
+		t.Fatal("challenge spent twice")
+	}
+	if !s.spend("b", expiresAt, now.Add(time.Second)) {
+		t.Fatal("different challenge refused")
+	}
+	if s.count != 2 {
+		t.Errorf("count = %d, want 2", s.count)
+	}
+
+	// Spent challenges are forgotten once they have expired, by which time
+	// they would be refused as expired anyway
+	later := expiresAt.Add(2 * time.Minute)
+	s.spend("c", later.Add(powTTL), later)
+	if _, ok := s.used["a"]; ok {
+		t.Error("expired challenge not swept")
+	}
+	if _, ok := s.used["c"]; !ok {
+		t.Error("live challenge swept")
+	}
+}
+
+func TestPowDifficulty(t *testing.T) {
+	defer func() {
+		viper.Set("pow-difficulty", 0)
+		viper.Set("pow-max-difficulty", 0)
+		viper.Set("pow-load", 0)
+	}()
+	viper.Set("pow-difficulty", 10)
+	viper.Set("pow-max-difficulty", 13)
+	viper.Set("pow-load", 10)
+
+	s := newPowState()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	spent := 0
+	spendN := func(n int) {
+		for i := 0; i < n; i++ {
+			spent++
+			s.spend(strconv.Itoa(spent), now.Add(powTTL), now)
+		}
+	}
+
+	if got := s.difficulty(now); got != 10 {
+		t.Errorf("idle difficulty = %d, want 10", got)
+	}
+	spendN(10)
+	if got := s.difficulty(now); got != 10 {
+		t.Errorf("difficulty at pow-load = %d, want 10", got)
+	}
+	spendN(10)
+	if got := s.difficulty(now); got != 12 {
+		t.Errorf("difficulty at twice pow-load = %d, want 12", got)
+	}
+	spendN(100)
+	if got := s.difficulty(now); got != 13 {
+		t.Errorf("difficulty is %d, want pow-max-difficulty 13", got)
+	}
+
+	viper.Set("pow-difficulty", 0)
+	if got := s.difficulty(now); got != 0 {
+		t.Errorf("disabled difficulty = %d, want 0", got)
+	}
+}
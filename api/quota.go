@@ -0,0 +1,325 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* Storage quotas
+The content of live pastes (by raw size, before deduplication and
+compression) counts against whoever created them: pastes made by a logged in
+user against their account, up to quota-user MB, and anonymous pastes
+against a hash of the IP address they came from, up to quota-ip MB. Admins
+have no quota. Writes that would take a client over its quota are rejected
+with 429 and writes that would take the server past storage-capacity MB in
+total with 507. A quota of 0 disables it.
+
+The server's total is worked out from the database at most every
+usageTTL and kept up to date in between by the writes made through it.
+*/
+const usageTTL time.Duration = 30 * time.Second
+
+type Usage struct {
+	Bytes  int64 `json:"bytes" bson:"bytes"`
+	Pastes int64 `json:"pastes" bson:"pastes"`
+}
+
+type globalUsage struct {
+	sync.Mutex
+	usage   Usage
+	checked time.Time
+}
+
+// Hash of the IP address a request comes from, anonymous pastes are
+// charged to it without keeping the address itself
+func (h *Handler) clientHash(r *http.Request) string {
+	return hashToken(h.clientIP(r))
+}
+
+func megabytes(key string) int64 {
+	return int64(viper.GetInt(key)) * 1024 * 1024
+}
+
+// Total size of the live pastes matching the filter
+func (h *Handler) sumUsage(ctx context.Context, filter bson.M) (Usage, error) {
+	var usage Usage
+	filter["expiresAt"] = bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())}
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$group": bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "bytes", Value: bson.M{"$sum": "$size"}},
+			{Key: "pastes", Value: bson.M{"$sum": 1}},
+		}},
+	}
+
+	cursor, err := h.pastes().Aggregate(ctx, pipeline)
+	if err != nil {
+		return usage, err
+	}
+	defer cursor.Close(ctx)
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&usage); err != nil {
+			return usage, err
+		}
+	}
+	return usage, cursor.Err()
+}
+
+// Filter matching the pastes charged to the same client as the paste and
+// that client's quota, pastes from before quotas belong to no one
+func pasteQuota(p *Paste) (bson.M, int64) {
+	switch {
+	case p.Owner != "":
+		return bson.M{"owner": p.Owner}, megabytes("quota-user")
+	case p.Client != "":
+		return bson.M{"client": p.Client, "owner": bson.M{"$exists": false}}, megabytes("quota-ip")
+	}
+	return nil, 0
+}
+
+func (h *Handler) serverUsage(ctx context.Context) (Usage, error) {
+	h.usage.Lock()
+	defer h.usage.Unlock()
+	if time.Since(h.usage.checked) < usageTTL {
+		return h.usage.usage, nil
+	}
+
+	usage, err := h.sumUsage(ctx, bson.M{})
+	if err != nil {
+		return usage, err
+	}
+	h.usage.usage = usage
+	h.usage.checked = time.Now()
+	return usage, nil
+}
+
+// Record a write that changed the server's total, pastes is -1, 0 or 1
+func (h *Handler) addUsage(bytes, pastes int64) {
+	h.usage.Lock()
+	defer h.usage.Unlock()
+	h.usage.usage.Bytes += bytes
+	h.usage.usage.Pastes += pastes
+}
+
+/* Check a write growing the paste's content by the given number of bytes
+fits in its client's quota and the server's capacity, writing the error
+response and returning false if not
+*/
+func (h *Handler) checkQuota(w http.ResponseWriter, r *http.Request, p *Paste, growth int) bool {
+	if growth <= 0 {
+		return true
+	}
+
+	if capacity := megabytes("storage-capacity"); capacity > 0 {
+		usage, err := h.serverUsage(r.Context())
+		if err != nil {
+			log.Print("error", "%v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return false
+		}
+		if usage.Bytes+int64(growth) > capacity {
+			log.Print("warn", "storage capacity of %d bytes reached", capacity)
+			http.Error(w, "Server storage capacity reached", http.StatusInsufficientStorage)
+			return false
+		}
+	}
+
+	if user := requestUser(r); user != nil && user.Admin {
+		return true
+	}
+	filter, quota := pasteQuota(p)
+	if filter == nil || quota <= 0 {
+		return true
+	}
+	usage, err := h.sumUsage(r.Context(), filter)
+	if err != nil {
+		log.Print("error", "%v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	if usage.Bytes+int64(growth) > quota {
+		http.Error(w, "Storage quota exceeded", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+/* GET /api/me/usage
+Returns a JSON document with how much the requester is storing, against
+their account when logged in or their IP address otherwise
+{
+	bytes:	Number,
+	pastes:	Number,
+	quota:	Number (bytes, 0 when unlimited)
+}
+*/
+func (h *Handler) getMyUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		p := &Paste{Client: h.clientHash(r)}
+		if user := requestUser(r); user != nil {
+			p.Owner = user.Username
+		}
+		filter, quota := pasteQuota(p)
+		if user := requestUser(r); user != nil && user.Admin {
+			quota = 0
+		}
+
+		usage, err := h.sumUsage(r.Context(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response := make(map[string]interface{})
+		response["bytes"] = usage.Bytes
+		response["pastes"] = usage.Pastes
+		response["quota"] = quota
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+/* GET /api/usage
+Admins only. Returns a JSON document with how much the server is storing
+and the accounts storing the most
+{
+	bytes:		Number,
+	pastes:		Number,
+	capacity:	Number (bytes, 0 when unlimited),
+	anonymous:	{ bytes: Number, pastes: Number },
+	users:		[{ username: String, bytes: Number, pastes: Number }, ...]
+}
+*/
+func (h *Handler) getUsage() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		user := requestUser(r)
+		if user == nil {
+			h.unauthorized(w, r)
+			return
+		}
+		if !user.Admin {
+			http.Error(w, "Only admins can view server usage", http.StatusForbidden)
+			return
+		}
+
+		total, err := h.sumUsage(r.Context(), bson.M{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		anonymous, err := h.sumUsage(r.Context(), bson.M{"owner": bson.M{"$exists": false}})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		pipeline := []bson.M{
+			{"$match": bson.M{
+				"owner":     bson.M{"$exists": true},
+				"expiresAt": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+			}},
+			{"$group": bson.D{
+				{Key: "_id", Value: "$owner"},
+				{Key: "bytes", Value: bson.M{"$sum": "$size"}},
+				{Key: "pastes", Value: bson.M{"$sum": 1}},
+			}},
+			{"$sort": bson.M{"bytes": -1}},
+			{"$limit": 50},
+		}
+		cursor, err := h.pastes().Aggregate(r.Context(), pipeline)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var results []struct {
+			Username string `bson:"_id"`
+			Usage    `bson:",inline"`
+		}
+		if err := cursor.All(r.Context(), &results); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		users := make([]map[string]interface{}, 0, len(results))
+		for _, res := range results {
+			users = append(users, map[string]interface{}{
+				"username": res.Username,
+				"bytes":    res.Bytes,
+				"pastes":   res.Pastes,
+			})
+		}
+
+		response := make(map[string]interface{})
+		response["bytes"] = total.Bytes
+		response["pastes"] = total.Pastes
+		response["capacity"] = megabytes("storage-capacity")
+		response["anonymous"] = anonymous
+		response["users"] = users
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPasteQuota(t *testing.T) {
+	setConfig(t, "quota-user", 500)
+	setConfig(t, "quota-ip", 50)
+
+	tests := []struct {
+		name       string
+		paste      *Paste
+		wantFilter bson.M
+		wantQuota  int64
+	}{
+		{"owner", &Paste{Owner: "alice", Client: "hash"}, bson.M{"owner": "alice"}, 500 << 20},
+		{"anonymous", &Paste{Client: "hash"}, bson.M{"client": "hash", "owner": bson.M{"$exists": false}}, 50 << 20},
+		{"from before quotas", &Paste{}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, quota := pasteQuota(tt.paste)
+			if !reflect.DeepEqual(filter, tt.wantFilter) || quota != tt.wantQuota {
+				t.Errorf("pasteQuota() = %v, %d, want %v, %d", filter, quota, tt.wantFilter, tt.wantQuota)
+			}
+		})
+	}
+}
+
+func TestCheckQuotaCapacity(t *testing.T) {
+	setConfig(t, "storage-capacity", 1)
+	capacity := int64(1 << 20)
+
+	tests := []struct {
+		name     string
+		used     int64
+		growth   int
+		user     *User
+		wantCode int
+	}{
+		{"fits", capacity - 100, 100, nil, http.StatusOK},
+		{"over capacity", capacity - 100, 101, nil, http.StatusInsufficientStorage},
+		{"shrinking", capacity + 100, -10, nil, http.StatusOK},
+		{"unchanged", capacity, 0, nil, http.StatusOK},
+		{"admins too", capacity, 1, &User{Username: "root", Admin: true}, http.StatusInsufficientStorage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{}
+			// Recently checked so the total isn't read from the database
+			h.usage.usage = Usage{Bytes: tt.used, Pastes: 1}
+			h.usage.checked = time.Now()
+
+			r := httptest.NewRequest(http.MethodPost, "/api/new", nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			}
+			w := httptest.NewRecorder()
+			ok := h.checkQuota(w, r, &Paste{}, tt.growth)
+			if ok != (tt.wantCode == http.StatusOK) || w.Code != tt.wantCode {
+				t.Errorf("checkQuota() = %v with status %d, want status %d", ok, w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAddUsage(t *testing.T) {
+	h := &Handler{}
+	h.usage.usage = Usage{Bytes: 1000, Pastes: 2}
+	for _, change := range []Usage{{500, 1}, {-200, 0}, {-300, -1}} {
+		h.addUsage(change.Bytes, change.Pastes)
+	}
+	if want := (Usage{Bytes: 1000, Pastes: 2}); h.usage.usage != want {
+		t.Errorf("usage = %+v, want %+v", h.usage.usage, want)
+	}
+}
+
+func TestQuotaAccounting(t *testing.T) {
+	setConfig(t, "max-size", 1)
+	setConfig(t, "quota-ip", 1)
+	h := NewHandler()
+	testDatabase(t, h)
+
+	// Just over half the quota, so only one fits at a time
+	body := `{"content":["` + strings.Repeat("a", 600*1024) + `"],"filetype":"text"}`
+	size := int64(600*1024 + 1)
+
+	type createdPaste struct {
+		UUID      string `json:"uuid"`
+		AccessKey string `json:"accessKey"`
+	}
+	var created []createdPaste
+	create := func() int {
+		var res createdPaste
+		code := serveJSON(t, h, http.MethodPost, "/api/new", body, &res)
+		if code == http.StatusCreated {
+			created = append(created, res)
+		}
+		return code
+	}
+	usage := func() int64 {
+		var res struct {
+			Bytes int64 `json:"bytes"`
+			Quota int64 `json:"quota"`
+		}
+		if code := serveJSON(t, h, http.MethodGet, "/api/me/usage", "", &res); code != http.StatusOK {
+			t.Fatalf("usage: status = %d", code)
+		}
+		if res.Quota != 1<<20 {
+			t.Errorf("quota = %d, want %d", res.Quota, 1<<20)
+		}
+		return res.Bytes
+	}
+
+	steps := []struct {
+		name      string
+		run       func() int
+		wantCode  int
+		wantBytes int64
+	}{
+		{"first paste", create, http.StatusCreated, size},
+		{"over quota", create, http.StatusTooManyRequests, size},
+		{"delete", func() int {
+			p := created[0]
+			return serveJSON(t, h, http.MethodDelete, "/api/"+p.UUID, `{"accessKey":"`+p.AccessKey+`"}`, nil)
+		}, http.StatusNoContent, 0},
+		{"fits again", create, http.StatusCreated, size},
+	}
+	for _, step := range steps {
+		if got := step.run(); got != step.wantCode {
+			t.Fatalf("%s: status = %d, want %d", step.name, got, step.wantCode)
+		}
+		if got := usage(); got != step.wantBytes {
+			t.Errorf("%s: usage = %d bytes, want %d", step.name, got, step.wantBytes)
+		}
+	}
+}
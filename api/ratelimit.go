@@ -0,0 +1,279 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+/* Rate limiting
+Every client gets a token bucket per class of route, refilling at the number
+of requests per minute set by the rate-limit-create, rate-limit-read and
+rate-limit-write config keys and holding up to a minute's worth of requests.
+Requests made with an API token are counted against the token, logged in
+users against their account and everyone else against their IP address,
+which is read from X-Forwarded-For when the request comes through one of
+the trusted-proxies. Requests with a token that is rejected are counted
+against the IP address before the 401 is sent. A limit of 0 disables
+limiting for that class.
+*/
+const (
+	rateCreate string = "create"
+	rateRead   string = "read"
+	rateWrite  string = "write"
+
+	// Buckets unused for this long are full again and can be forgotten
+	rateIdle time.Duration = 10 * time.Minute
+)
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	perMin  int
+	seen    time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*rateBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take a request from the client's bucket for the class, returning the
+// bucket's remaining requests and how long until it is full again, or how
+// long to wait before retrying if it is empty
+func (l *rateLimiter) take(key string, perMin int, now time.Time) (ok bool, remaining int, wait time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > rateIdle {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	every := rate.Limit(float64(perMin) / 60)
+	b, found := l.buckets[key]
+	if !found {
+		b = &rateBucket{limiter: rate.NewLimiter(every, perMin), perMin: perMin}
+		l.buckets[key] = b
+	} else if b.perMin != perMin {
+		// The limit has been changed in the config
+		b.limiter.SetLimitAt(now, every)
+		b.limiter.SetBurstAt(now, perMin)
+		b.perMin = perMin
+	}
+	b.seen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, 0, delay
+	}
+
+	tokens := b.limiter.TokensAt(now)
+	missing := float64(perMin) - tokens
+	return true, int(math.Max(tokens, 0)), time.Duration(missing / float64(every) * float64(time.Second))
+}
+
+// The class a request's route is limited under
+func rateClass(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return rateRead
+	case http.MethodPost:
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ := route.GetPathTemplate()
+			switch tmpl {
+			case "/api/new", "/api/{uuid}/comments", "/api/{uuid}/report":
+				return rateCreate
+			}
+		}
+	}
+	return rateWrite
+}
+
+// Who a request is counted against, each API token gets its own bucket
+// while sessions and ID tokens share the user's
+func (h *Handler) rateKey(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if ok && strings.EqualFold(scheme, "Bearer") && strings.HasPrefix(token, tokenPrefix) {
+			return "token:" + hashToken(token)
+		}
+		return "user:" + user.Username
+	}
+	return "ip:" + h.clientIP(r)
+}
+
+// Parse an IP address or CIDR range, a single address is a range of one
+func parseNet(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", entry)
+		}
+		if ip.To4() != nil {
+			entry += "/32"
+		} else {
+			entry += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(entry)
+	return n, err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/* The IP address of the client making the request
+Forwarding headers are only believed when the connection comes from a
+trusted proxy, X-Forwarded-For is read from the right skipping any trusted
+proxies so a client can't choose its own address by sending the header.
+When the header is missing or a hop can't be parsed the last address known
+is used, X-Real-IP is never read as the client can set it itself. The
+trusted-proxies are parsed along with the access lists.
+*/
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	h.access.RLock()
+	proxies := h.access.proxies
+	h.access.RUnlock()
+	if !containsIP(proxies, ip) {
+		if len(proxies) == 0 && r.Header.Get("X-Forwarded-For") != "" {
+			h.access.warnUntrusted.Do(func() {
+				log.Print("warn", "request from %s has X-Forwarded-For but trusted-proxies "+
+					"is empty, every client behind the proxy shares its rate limits and "+
+					"quotas, list the proxy in trusted-proxies", ip)
+			})
+		}
+		return ip.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(proxies, hop) {
+			return hop.String()
+		}
+	}
+	return ip.String()
+}
+
+// Middleware limiting the rate of requests from each client
+func (h *Handler) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := rateClass(r)
+		perMin := viper.GetInt("rate-limit-" + class)
+		if perMin <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if h.takeRate(w, class, h.rateKey(r), perMin) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+/* Take a request from the key's bucket for the class and set the
+RateLimit headers, if the bucket is empty a 429 is sent and false is
+returned in which case the handler should stop
+*/
+func (h *Handler) takeRate(w http.ResponseWriter, class, key string, perMin int) bool {
+	ok, remaining, wait := h.limiter.take(class+" "+key, perMin, time.Now())
+	seconds := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=60", perMin))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(perMin))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", seconds)
+	if !ok {
+		log.Print("warn", "rate limited %s request from %s", class, key)
+		w.Header().Set("Retry-After", seconds)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// Count a request whose credentials were rejected against the client's IP
+// address, so guessing tokens is limited like any anonymous request.
+// Returns false if a 429 has been sent
+func (h *Handler) limitFailedAuth(w http.ResponseWriter, r *http.Request) bool {
+	class := rateClass(r)
+	perMin := viper.GetInt("rate-limit-" + class)
+	if perMin <= 0 {
+		return true
+	}
+	return h.takeRate(w, class, "ip:"+h.clientIP(r), perMin)
+}
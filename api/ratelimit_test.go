@@ -0,0 +1,222 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		steps  func(l *rateLimiter)
+		key    string
+		perMin int
+		at     time.Time
+		wantOK bool
+		// Remaining after the request, or seconds to wait when refused
+		want int
+	}{
+		{"first request", func(l *rateLimiter) {}, "a", 3, now, true, 2},
+		{"bucket empty", func(l *rateLimiter) {
+			for i := 0; i < 3; i++ {
+				l.take("a", 3, now)
+			}
+		}, "a", 3, now, false, 20},
+		{"other key", func(l *rateLimiter) {
+			for i := 0; i < 3; i++ {
+				l.take("a", 3, now)
+			}
+		}, "b", 3, now, true, 2},
+		{"refilled", func(l *rateLimiter) {
+			for i := 0; i < 3; i++ {
+				l.take("a", 3, now)
+			}
+		}, "a", 3, now.Add(20 * time.Second), true, 0},
+		{"limit raised", func(l *rateLimiter) {
+			for i := 0; i < 3; i++ {
+				l.take("a", 3, now)
+			}
+			// Refills at the new rate from when the limit changed
+			l.take("a", 60, now.Add(time.Second))
+		}, "a", 60, now.Add(2 * time.Second), true, 0},
+		{"idle bucket forgotten", func(l *rateLimiter) {
+			for i := 0; i < 3; i++ {
+				l.take("a", 3, now)
+			}
+			l.take("b", 3, now.Add(rateIdle+2*time.Minute))
+		}, "a", 3, now.Add(rateIdle + 2*time.Minute), true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter()
+			l.lastSweep = now
+			tt.steps(l)
+			ok, remaining, wait := l.take(tt.key, tt.perMin, tt.at)
+			if ok != tt.wantOK {
+				t.Fatalf("take() ok = %v, want %v", ok, tt.wantOK)
+			}
+			got := remaining
+			if !ok {
+				got = int(wait.Round(time.Second).Seconds())
+			}
+			if got != tt.want {
+				t.Errorf("take() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxy, err := parseNet("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    []*net.IPNet
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{"direct", nil, "203.0.113.7:1234", "", "", "203.0.113.7"},
+		{"forwarded without trusted proxies", nil, "203.0.113.7:1234", "198.51.100.1", "", "203.0.113.7"},
+		{"untrusted proxy", []*net.IPNet{proxy}, "203.0.113.7:1234", "198.51.100.1", "", "203.0.113.7"},
+		{"trusted proxy", []*net.IPNet{proxy}, "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed hop before client", []*net.IPNet{proxy}, "10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"proxy chain", []*net.IPNet{proxy}, "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"all hops trusted", []*net.IPNet{proxy}, "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"unparseable hop", []*net.IPNet{proxy}, "10.0.0.1:1234", "198.51.100.1, junk, 10.0.0.2", "", "10.0.0.2"},
+		{"no header from proxy", []*net.IPNet{proxy}, "10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"X-Real-IP ignored", []*net.IPNet{proxy}, "10.0.0.1:1234", "", "198.51.100.9", "10.0.0.1"},
+		{"ipv6", nil, "[2001:db8::1]:1234", "", "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{}
+			h.access.proxies = tt.proxies
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := h.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateKey(t *testing.T) {
+	alice := &User{Username: "alice"}
+	tests := []struct {
+		name   string
+		user   *User
+		bearer string
+		want   string
+	}{
+		{"anonymous", nil, "", "ip:203.0.113.7"},
+		{"rejected token", nil, tokenPrefix + "nope", "ip:203.0.113.7"},
+		{"session", alice, "", "user:alice"},
+		{"api token", alice, tokenPrefix + "secret", "token:" + hashToken(tokenPrefix+"secret")},
+		{"id token", alice, "eyJhbGciOiJSUzI1NiJ9.e30.sig", "user:alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "203.0.113.7:1234"
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			}
+			if got := h.rateKey(r); got != tt.want {
+				t.Errorf("rateKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	setConfig(t, "rate-limit-read", 2)
+	paste := testPaste("3e4f5a6b-7c8d-4e9f-a0b1-c2d3e4f5a6b7", "content")
+	h := newTestHandler(t, paste)
+	target := "/" + paste.UUID + "/raw"
+
+	tests := []struct {
+		remoteAddr string
+		wantCode   int
+		remaining  string
+	}{
+		{"203.0.113.7:1234", http.StatusOK, "1"},
+		{"203.0.113.7:1234", http.StatusOK, "0"},
+		{"203.0.113.7:1234", http.StatusTooManyRequests, "0"},
+		{"203.0.113.8:1234", http.StatusOK, "1"},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.wantCode {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, tt.wantCode)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: RateLimit-Limit = %q, want %q", i, got, "2")
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != tt.remaining {
+			t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i, got, tt.remaining)
+		}
+		retry := w.Header().Get("Retry-After")
+		if tt.wantCode == http.StatusTooManyRequests {
+			if seconds, err := strconv.Atoi(retry); err != nil || seconds < 1 || seconds > 30 {
+				t.Errorf("request %d: Retry-After = %q, want 1-30 seconds", i, retry)
+			}
+		} else if retry != "" {
+			t.Errorf("request %d: Retry-After = %q on an allowed request", i, retry)
+		}
+	}
+}
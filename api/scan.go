@@ -0,0 +1,249 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+/* Secret scanning
+Content is checked for credentials pasted by mistake when a paste is created
+or its content updated. What happens to any found depends on the
+secret-scan config key:
+	off	-> content isn't scanned
+	warn	-> the paste is stored as is and the response lists what was found
+	redact	-> what was found is replaced before the paste is stored
+	reject	-> the paste isn't stored
+Private key blocks are matched from their BEGIN line to their END line, the
+other patterns within a single line.
+*/
+const (
+	scanOff    string = "off"
+	scanWarn   string = "warn"
+	scanRedact string = "redact"
+	scanReject string = "reject"
+
+	redacted string = "[REDACTED]"
+
+	// Strings of base64-ish characters at least this long with more bits of
+	// entropy per character than the threshold look like keys, hex digests
+	// can't go above 4 bits per character so don't match
+	entropyMinLength int     = 32
+	entropyThreshold float64 = 4.5
+)
+
+type secretPattern struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+var (
+	secretPatterns = []secretPattern{
+		{"aws-access-key-id", regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`)},
+		{"aws-secret-access-key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`)},
+		{"gcp-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+		{"gcp-service-account", regexp.MustCompile(`"private_key_id"\s*:\s*"[0-9a-f]{40}"`)},
+		{"github-token", regexp.MustCompile(`\b(?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36}\b`)},
+		{"github-token", regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{82}\b`)},
+	}
+
+	pemBegin = regexp.MustCompile(`-----BEGIN ((?:RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)
+	pemEnd   = regexp.MustCompile(`-----END ((?:RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)
+
+	entropyCandidate = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{32,}`)
+)
+
+// A secret found in content, lines are numbered from 1
+type SecretFinding struct {
+	Type    string `json:"type"`
+	Line    int    `json:"line"`
+	EndLine int    `json:"endLine,omitempty"`
+}
+
+// The secret-scan policy, unknown values are treated as warn
+func scanPolicy() string {
+	switch policy := strings.ToLower(viper.GetString("secret-scan")); policy {
+	case scanOff, scanRedact, scanReject:
+		return policy
+	}
+	return scanWarn
+}
+
+// Bits of entropy per character of the string
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// Long random looking strings mixing letters and digits
+func highEntropy(s string) bool {
+	if len(s) < entropyMinLength || !strings.ContainsAny(s, "0123456789") {
+		return false
+	}
+	if strings.ToLower(s) == s || strings.ToUpper(s) == s {
+		return false
+	}
+	return shannonEntropy(s) > entropyThreshold
+}
+
+/* Scan the content for secrets, returning what was found and when redact is
+set the content with them replaced
+*/
+func scanSecrets(content []string, redact bool) ([]SecretFinding, []string) {
+	var findings []SecretFinding
+	out := content
+	if redact {
+		out = make([]string, len(content))
+		copy(out, content)
+	}
+
+	for i := 0; i < len(content); i++ {
+		line := content[i]
+
+		if loc := pemBegin.FindStringIndex(line); loc != nil {
+			end := i
+			for j := i; j < len(content); j++ {
+				if pemEnd.MatchString(content[j]) {
+					end = j
+					break
+				}
+				if j == len(content)-1 {
+					end = j
+				}
+			}
+			finding := SecretFinding{Type: "private-key", Line: i + 1}
+			if end > i {
+				finding.EndLine = end + 1
+			}
+			findings = append(findings, finding)
+			if redact {
+				out[i] = line[:loc[0]] + redacted
+				for j := i + 1; j <= end; j++ {
+					out[j] = redacted
+				}
+			}
+			i = end
+			continue
+		}
+
+		matched := false
+		for _, sp := range secretPatterns {
+			if !sp.pattern.MatchString(line) {
+				continue
+			}
+			matched = true
+			findings = append(findings, SecretFinding{Type: sp.kind, Line: i + 1})
+			if redact {
+				out[i] = redactMatches(sp.pattern, out[i])
+			}
+		}
+		if matched {
+			continue
+		}
+
+		for _, candidate := range entropyCandidate.FindAllString(out[i], -1) {
+			if !highEntropy(candidate) {
+				continue
+			}
+			findings = append(findings, SecretFinding{Type: "high-entropy-string", Line: i + 1})
+			if redact {
+				out[i] = strings.Replace(out[i], candidate, redacted, 1)
+			}
+			break
+		}
+	}
+
+	return findings, out
+}
+
+// Replace every match of the pattern in the line, only replacing the first
+// group for patterns which have one around the secret itself
+func redactMatches(pattern *regexp.Regexp, line string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range pattern.FindAllStringSubmatchIndex(line, -1) {
+		start, end := loc[0], loc[1]
+		if len(loc) > 2 && loc[2] >= 0 {
+			start, end = loc[2], loc[3]
+		}
+		sb.WriteString(line[last:start])
+		sb.WriteString(redacted)
+		last = end
+	}
+	sb.WriteString(line[last:])
+	return sb.String()
+}
+
+// Describe the findings for an error message
+func describeSecrets(findings []SecretFinding) string {
+	parts := make([]string, 0, len(findings))
+	for _, f := range findings {
+		if f.EndLine > 0 {
+			parts = append(parts, fmt.Sprintf("%s on lines %d-%d", f.Type, f.Line, f.EndLine))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s on line %d", f.Type, f.Line))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+/* Apply the secret-scan policy to the paste's content, returning what was
+found for the response or an error if the paste must be rejected
+*/
+func (p *Paste) scanContent() ([]SecretFinding, error) {
+	policy := scanPolicy()
+	if policy == scanOff {
+		return nil, nil
+	}
+
+	findings, content := scanSecrets(p.Content, policy == scanRedact)
+	if len(findings) == 0 {
+		return nil, nil
+	}
+	if policy == scanReject {
+		return findings, fmt.Errorf("Content appears to contain secrets: %s", describeSecrets(findings))
+	}
+	p.Content = content
+	return findings, nil
+}
@@ -0,0 +1,311 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/h5law/paste-server/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Full-text search
+Public pastes can be searched through a MongoDB text index over their
+title, description, tags and content. Content lives in blobs shared with
+private pastes so rather than a second copy of it public pastes carry
+searchTerms, the distinct lowercased words of their content, which is the
+only field the index covers that isn't returned to clients. Private pastes
+never have it set so are never matched. Snippets are cut from the content
+itself once the matches are found.
+*/
+const (
+	maxSearchTerms  int = 4096
+	maxTermLength   int = 64
+	maxSnippetText  int = 64 * 1024
+	maxQueryLength  int = 256
+	snippetLength   int = 200
+	snippetLeadIn   int = 60
+	searchIndexName     = "search"
+)
+
+// Words of the paste to index, nil for pastes that aren't public. Each word
+// is kept once in the order it first appears, overly long words (hashes,
+// base64 and the like) are left out
+func (p *Paste) searchTerms() []string {
+	if !p.Public {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var terms []string
+	for _, line := range p.Content {
+		words := strings.FieldsFunc(stripANSI(line), func(c rune) bool {
+			return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+		})
+		for _, word := range words {
+			word = strings.ToLower(word)
+			if utf8.RuneCountInString(word) > maxTermLength || seen[word] {
+				continue
+			}
+			seen[word] = true
+			terms = append(terms, word)
+			if len(terms) == maxSearchTerms {
+				return terms
+			}
+		}
+	}
+	return terms
+}
+
+// Text of the paste snippets are cut from, the start of its content
+func snippetText(content []string) string {
+	var sb strings.Builder
+	for _, line := range content {
+		if sb.Len() >= maxSnippetText {
+			break
+		}
+		sb.WriteString(stripANSI(line))
+		sb.WriteByte('\n')
+	}
+	text := sb.String()
+	if len(text) <= maxSnippetText {
+		return text
+	}
+
+	// Don't cut a multi-byte character in half
+	end := maxSnippetText
+	for end > 0 && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end]
+}
+
+// Matches any of the terms of a search query case-insensitively, negated
+// terms are left out as they can't appear in a result
+func termPattern(query string) *regexp.Regexp {
+	var terms []string
+	for _, term := range strings.Fields(query) {
+		if strings.HasPrefix(term, "-") {
+			continue
+		}
+		term = strings.Trim(term, `"`)
+		if term != "" {
+			terms = append(terms, regexp.QuoteMeta(term))
+		}
+	}
+	if len(terms) == 0 {
+		return nil
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(terms, "|"))
+}
+
+/* Cut a snippet of text around the first match of the query with every
+match wrapped in <mark>, the rest of the snippet is HTML escaped. Falls
+back to the start of the text when the match came from stemming.
+*/
+func highlightSnippet(text string, terms *regexp.Regexp) string {
+	start := 0
+	if terms != nil {
+		if loc := terms.FindStringIndex(text); loc != nil && loc[0] > snippetLeadIn {
+			start = loc[0] - snippetLeadIn
+		}
+	}
+	end := start + snippetLength
+	if end > len(text) {
+		end = len(text)
+	}
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	window := strings.Join(strings.Fields(text[start:end]), " ")
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	last := 0
+	if terms != nil {
+		for _, loc := range terms.FindAllStringIndex(window, -1) {
+			sb.WriteString(html.EscapeString(window[last:loc[0]]))
+			sb.WriteString("<mark>")
+			sb.WriteString(html.EscapeString(window[loc[0]:loc[1]]))
+			sb.WriteString("</mark>")
+			last = loc[1]
+		}
+	}
+	sb.WriteString(html.EscapeString(window[last:]))
+	if end < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
+
+/* GET /api/search
+Query:
+	"q"        -> required (words to search for, "quoted phrases" and -negations)
+	"filetype" -> optional
+	"tag"      -> optional
+	"page"     -> optional (1-based, defaults to 1)
+	"limit"    -> optional (results per page, 1-100 defaults to 20)
+
+Searches the public pastes returning the best matches first in JSON
+{
+	results:	[{ uuid: UUID, title: String, description: String,
+		tags: []String, filetype: String, filename: String, size: Number,
+		updatedAt: Date, expiresAt: Date, score: Number, snippet: String }],
+	page:		Number,
+	limit:		Number,
+	total:		Number
+}
+snippet is HTML with the matched terms wrapped in <mark>
+*/
+func (h *Handler) searchPastes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		q := r.URL.Query()
+		query := strings.TrimSpace(q.Get("q"))
+		if query == "" {
+			http.Error(w, "Search query is required", http.StatusBadRequest)
+			return
+		}
+		if len(query) > maxQueryLength {
+			http.Error(w, fmt.Sprintf("Search query must not be longer than %d characters", maxQueryLength), http.StatusBadRequest)
+			return
+		}
+		page, limit, err := parsePage(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := bson.M{
+			"$text":     bson.M{"$search": query},
+			"public":    true,
+			"hidden":    bson.M{"$ne": true},
+			"expiresAt": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now())},
+		}
+		if ft := q.Get("filetype"); ft != "" {
+			filetype, ok := normalizeFileType(ft)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Unknown filetype: %s", ft), http.StatusBadRequest)
+				return
+			}
+			filter["filetype"] = filetype
+		}
+		if tag := q.Get("tag"); tag != "" {
+			tags, err := normalizeTags([]string{tag})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter["tags"] = tags[0]
+		}
+
+		total, err := h.pastes().CountDocuments(r.Context(), filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		score := bson.M{"$meta": "textScore"}
+		project := bson.M{"score": score}
+		for field := range summaryProjection {
+			project[field] = summaryProjection[field]
+		}
+		opts := options.Find().
+			SetProjection(project).
+			SetSort(bson.D{{Key: "score", Value: score}}).
+			SetSkip(int64((page - 1) * limit)).
+			SetLimit(int64(limit))
+		cursor, err := h.pastes().Find(r.Context(), filter, opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var matches []struct {
+			Paste `bson:",inline"`
+			Score float64 `bson:"score"`
+		}
+		if err := cursor.All(r.Context(), &matches); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		terms := termPattern(query)
+		results := make([]map[string]interface{}, 0, len(matches))
+		for i := range matches {
+			result := matches[i].summary()
+			result["score"] = matches[i].Score
+			snippet := ""
+			if paste, err := h.findPaste(r.Context(), matches[i].UUID); err == nil {
+				snippet = highlightSnippet(snippetText(paste.Content), terms)
+			} else {
+				log.Print("error", "loading %s for its snippet: %v", matches[i].UUID, err)
+			}
+			result["snippet"] = snippet
+			results = append(results, result)
+		}
+
+		response := make(map[string]interface{})
+		response["results"] = results
+		response["page"] = page
+		response["limit"] = limit
+		response["total"] = total
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
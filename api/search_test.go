@@ -0,0 +1,72 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	long := strings.Repeat("a", maxTermLength+1)
+	tests := []struct {
+		name    string
+		public  bool
+		content []string
+		want    []string
+	}{
+		{"private", false, []string{"hello world"}, nil},
+		{"words", true, []string{"Hello, world!", "hello again"}, []string{"hello", "world", "again"}},
+		{"punctuation", true, []string{"kafka.leader=not_available"}, []string{"kafka", "leader", "not", "available"}},
+		{"ansi", true, []string{"\x1b[31merror\x1b[0m"}, []string{"error"}},
+		{"long words", true, []string{long + " short"}, []string{"short"}},
+		{"unicode", true, []string{"Grüße ΚΌΣΜΕ"}, []string{"grüße", "κόσμε"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Paste{Public: tt.public, Content: tt.content}
+			if got := p.searchTerms(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("searchTerms() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	var many []string
+	for i := 0; i < maxSearchTerms+10; i++ {
+		many = append(many, fmt.Sprintf("word%d", i))
+	}
+	p := &Paste{Public: true, Content: many}
+	if got := len(p.searchTerms()); got != maxSearchTerms {
+		t.Errorf("len(searchTerms()) = %d, want %d", got, maxSearchTerms)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+)
+
+/* Server secret
+Values the server hands out and later has to trust (session cookies, login
+state) are signed with keys derived from the `secret` config key, one key
+per purpose so a value signed for one use is never accepted for another.
+Without a configured secret a random one is generated at startup, which
+means anything signed is invalidated when the server restarts.
+*/
+var (
+	generatedSecret []byte
+	secretOnce      sync.Once
+
+	errInvalidSignature = errors.New("Invalid signature")
+)
+
+func serverSecret() []byte {
+	if secret := viper.GetString("secret"); secret != "" {
+		return []byte(secret)
+	}
+
+	secretOnce.Do(func() {
+		generatedSecret = make([]byte, 32)
+		if _, err := rand.Read(generatedSecret); err != nil {
+			log.Print("fatal", "failed to generate secret: %v", err)
+		}
+		log.Print("warn", "`secret` not set in config file, signed values won't survive a restart")
+	})
+	return generatedSecret
+}
+
+// Key for signing values used for the given purpose
+func serverKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, serverSecret())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func signature(purpose string, data []byte) []byte {
+	mac := hmac.New(sha256.New, serverKey(purpose))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Encode the payload along with its signature as "payload.signature"
+func signValue(purpose string, payload []byte) string {
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	sig := signature(purpose, []byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// Check the signature of a value made by signValue and return its payload
+func verifyValue(purpose, value string) ([]byte, error) {
+	encoded, sigStr, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigStr)
+	if err != nil || !hmac.Equal(sig, signature(purpose, []byte(encoded))) {
+		return nil, errInvalidSignature
+	}
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
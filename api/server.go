@@ -36,8 +36,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -72,6 +73,13 @@ type spaHandler struct {
 }
 
 func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the SPA runs its own scripts and styles, only from this origin
+	csp := viper.GetString("spa-csp")
+	if csp == "" {
+		csp = spaCSP
+	}
+	w.Header().Set("Content-Security-Policy", csp)
+
 	// get the absolute path to prevent directory traversal
 	path, err := filepath.Abs(r.URL.Path)
 	if err != nil {
@@ -85,10 +93,14 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path = filepath.Join(h.staticPath, path)
 
 	// check whether a file exists at the given path
-	_, err = os.Stat(path)
+	info, err := os.Stat(path)
 	if os.IsNotExist(err) {
 		// file does not exist, serve index.html
-		http.ServeFile(w, r, filepath.Join(h.staticPath, h.indexPath))
+		index := filepath.Join(h.staticPath, h.indexPath)
+		if servePrecompressed(w, r, index) {
+			return
+		}
+		http.ServeFile(w, r, index)
 		return
 	} else if err != nil {
 		// if we got an error (that wasn't that the file doesn't exist) stating the
@@ -97,10 +109,55 @@ func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// prefer a precompressed copy of the file if there is one
+	if !info.IsDir() && servePrecompressed(w, r, path) {
+		return
+	}
+
 	// otherwise, use http.FileServer to serve the static dir
 	http.FileServer(http.Dir(h.staticPath)).ServeHTTP(w, r)
 }
 
+/* Serve a .br or .gz copy of the file at path if one exists and the client
+accepts that encoding, returns false if nothing was served
+*/
+func servePrecompressed(w http.ResponseWriter, r *http.Request, path string) bool {
+	extensions := map[string]string{"br": ".br", "gzip": ".gz"}
+	var available []string
+	for _, enc := range supportedEncodings {
+		if exists, _ := utils.FileExists(path + extensions[enc]); exists {
+			available = append(available, enc)
+		}
+	}
+	if len(available) == 0 {
+		return false
+	}
+	addVary(w.Header(), "Accept-Encoding")
+
+	enc := negotiateEncoding(r.Header.Get("Accept-Encoding"), available)
+	if enc == "" {
+		return false
+	}
+
+	f, err := os.Open(path + extensions[enc])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	// Content-Type comes from the original file not the compressed copy
+	if ctype := mime.TypeByExtension(filepath.Ext(path)); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	w.Header().Set("Content-Encoding", enc)
+	http.ServeContent(w, r, filepath.Base(path), info.ModTime(), f)
+	return true
+}
+
 /* Handler for api and mongodb connections that stores both the
 mux.Router and the mongodb client instance
 */
@@ -108,6 +165,23 @@ mux.Router and the mongodb client instance
 type Handler struct {
 	*mux.Router
 	*mongo.Client
+	cache   *pasteCache
+	oidc    *oidcAuth
+	limiter *rateLimiter
+	usage   globalUsage
+	pow     *powState
+	access  accessLists
+
+	// Origin raw content is served from, nil for the main origin
+	rawOrigin *url.URL
+	// Public URL of the server, nil when links are relative
+	baseURL *url.URL
+	// Name of the database everything is kept in, dbName unless testing
+	db string
+}
+
+func (h *Handler) database() *mongo.Database {
+	return h.Client.Database(h.db)
 }
 
 func (h *Handler) ConnectDB(uri string) {
@@ -120,9 +194,17 @@ func (h *Handler) ConnectDB(uri string) {
 	}
 	h.Client = client
 	log.Print("info", "connected to database")
+
+	// Existing indexes with different options are left alone
+	if err := h.ensureIndexes(context.Background()); err != nil {
+		log.Print("warn", "failed to create indexes: %v", err)
+	}
 }
 
 func (h *Handler) DisconnectDB() {
+	if hits, misses, entries := h.cache.stats(); hits+misses > 0 {
+		log.Print("info", "read cache: %d hits, %d misses, %d entries", hits, misses, entries)
+	}
 	if err := h.Client.Disconnect(context.Background()); err != nil {
 		log.Print("fatal", "failed to disconnect from database: %v", err)
 	}
@@ -131,23 +213,61 @@ func (h *Handler) DisconnectDB() {
 }
 
 func (h *Handler) routes() {
-	h.HandleFunc("/api/new", h.createPaste()).Methods("POST")
-	h.HandleFunc("/api/{uuid}", h.getPaste()).Methods("GET")
+	h.HandleFunc("/api/new", h.requireAuth(authCreate, h.createPaste())).Methods("POST")
+	h.HandleFunc("/api/filetypes", h.getFileTypes()).Methods("GET")
+	h.HandleFunc("/api/challenge", h.getChallenge()).Methods("GET")
+	h.HandleFunc("/api/pastes", h.requireAuth(authRead, h.listPastes())).Methods("GET")
+	h.HandleFunc("/api/search", h.requireAuth(authRead, h.searchPastes())).Methods("GET")
+	h.HandleFunc("/api/me", h.getMe()).Methods("GET")
+	h.HandleFunc("/api/me/pastes", h.getMyPastes()).Methods("GET")
+	h.HandleFunc("/api/me/usage", h.getMyUsage()).Methods("GET")
+	h.HandleFunc("/api/usage", h.getUsage()).Methods("GET")
+	h.HandleFunc("/api/reports", h.getReports()).Methods("GET")
+	h.HandleFunc("/api/reports/{uuid}", h.moderatePaste()).Methods("POST")
+	h.HandleFunc("/api/{uuid}", h.requireAuthOrGrant(authRead, h.getPaste())).Methods("GET")
 	h.HandleFunc("/api/{uuid}", h.updatePaste()).Methods("PUT")
 	h.HandleFunc("/api/{uuid}", h.deletePaste()).Methods("DELETE")
-	h.HandleFunc("/{uuid}/raw", h.getRawPasteHTML()).Methods("GET")
+	h.HandleFunc("/api/{uuid}/comments", h.requireAuth(authCreate, h.createComment())).Methods("POST")
+	h.HandleFunc("/api/{uuid}/comments", h.requireAuthOrGrant(authRead, h.getComments())).Methods("GET")
+	h.HandleFunc("/api/{uuid}/comments/{id}", h.deleteComment()).Methods("DELETE")
+	h.HandleFunc("/api/{uuid}/keys", h.createKey()).Methods("POST")
+	h.HandleFunc("/api/{uuid}/keys", h.getKeys()).Methods("GET")
+	h.HandleFunc("/api/{uuid}/keys/{id}", h.revokeKey()).Methods("DELETE")
+	h.HandleFunc("/api/{uuid}/rotate-key", h.rotateKey()).Methods("POST")
+	h.HandleFunc("/api/{uuid}/share", h.createShare()).Methods("POST")
+	h.HandleFunc("/api/{uuid}/report", h.requireAuth(authCreate, h.reportPaste())).Methods("POST")
+	h.HandleFunc("/auth/login", h.login()).Methods("GET")
+	h.HandleFunc("/auth/callback", h.loginCallback()).Methods("GET")
+	h.HandleFunc("/auth/logout", h.logout()).Methods("POST")
+	h.HandleFunc("/{uuid}/raw", h.requireAuthOrGrant(authRead, h.getRawPasteHTML())).Methods("GET")
+	h.HandleFunc("/{uuid}/rendered", h.requireAuthOrGrant(authRead, h.getRenderedPasteHTML())).Methods("GET")
 
 	if spaDir := viper.GetString("spa-dir"); spaDir == "" {
-		h.HandleFunc("/{uuid}", h.getPasteHTML()).Methods("GET")
+		h.HandleFunc("/{uuid}", h.requireAuthOrGrant(authRead, h.getPasteHTML())).Methods("GET")
 	}
 }
 
 func NewHandler() *Handler {
 	h := &Handler{
 		Router: mux.NewRouter(),
+		cache: newPasteCache(
+			viper.GetInt("cache-size"),
+			time.Duration(viper.GetInt("cache-ttl"))*time.Second,
+		),
+		limiter: newRateLimiter(),
+		pow:     newPowState(),
+		db:      dbName,
 	}
 
 	h.routes()
+	h.Use(securityHeaders)
+	h.Use(compressHandler)
+	h.Use(h.accessControl)
+	h.Use(h.authenticate)
+	h.Use(h.separateRawOrigin)
+	h.Use(h.rateLimit)
+	h.NotFoundHandler = securityHeaders(http.NotFoundHandler())
+	h.MethodNotAllowedHandler = securityHeaders(http.HandlerFunc(methodNotAllowed))
 
 	if spaDir := viper.GetString("spa-dir"); spaDir != "" {
 		exists, err := utils.FileExists(spaDir)
@@ -168,30 +288,62 @@ func NewHandler() *Handler {
 }
 
 type PasteBody struct {
-	Content   []string `json:"content"`
-	FileType  string   `json:"filetype,omitempty"`
-	ExpiresIn int      `json:"expiresIn,omitempty"`
-	AccessKey string   `json:"accessKey,omitempty"`
+	Content     []string `json:"content"`
+	FileType    string   `json:"filetype,omitempty"`
+	Filename    string   `json:"filename,omitempty"`
+	ExpiresIn   int      `json:"expiresIn,omitempty"`
+	AccessKey   string   `json:"accessKey,omitempty"`
+	Title       *string  `json:"title,omitempty"`
+	Description *string  `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Public      *bool    `json:"public,omitempty"`
+	Private     *bool    `json:"private,omitempty"`
 }
 
 type Paste struct {
 	UUID      string             `json:"uuid,omitempty" bson:"uuid,omitempty"`
 	Content   []string           `json:"content,omitempty" bson:"content,omitempty"`
 	FileType  string             `json:"filetype,omitempty" bson:"filetype,omitempty"`
+	Filename  string             `json:"filename,omitempty" bson:"filename,omitempty"`
+	Detected  *Detection         `json:"detected,omitempty" bson:"detected,omitempty"`
 	ExpiresAt primitive.DateTime `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	UpdatedAt primitive.DateTime `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+	Revision  int                `json:"revision,omitempty" bson:"revision,omitempty"`
 	AccessKey string             `json:"accessKey,omitempty" bson:"accessKey,omitempty"`
+	Owner     string             `json:"-" bson:"owner,omitempty"`
+	Client    string             `json:"-" bson:"client,omitempty"`
+	Private   bool               `json:"private,omitempty" bson:"private,omitempty"`
+	Keys      []pasteKey         `json:"-" bson:"keys,omitempty"`
+	Hidden    bool               `json:"-" bson:"hidden,omitempty"`
+	Reported  bool               `json:"-" bson:"reported,omitempty"`
+
+	// Optional metadata, only public pastes are listed
+	Title       string   `json:"title,omitempty" bson:"title,omitempty"`
+	Description string   `json:"description,omitempty" bson:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty" bson:"tags,omitempty"`
+	Public      bool     `json:"public,omitempty" bson:"public,omitempty"`
+	SearchTerms []string `json:"-" bson:"searchTerms,omitempty"`
+
+	// Storage details, ContentHash names the blob holding the content while
+	// pastes stored before blobs hold it inline (compressed in Data when
+	// Codec is set)
+	ContentHash string `json:"contentHash,omitempty" bson:"contentHash,omitempty"`
+	Size        int    `json:"size,omitempty" bson:"size,omitempty"`
+	StoredSize  int    `json:"-" bson:"storedSize,omitempty"`
+	Codec       string `json:"-" bson:"codec,omitempty"`
+	Data        []byte `json:"-" bson:"data,omitempty"`
 }
 
 var charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// Keys guard pastes so they come from crypto/rand, which only fails if the
+// system's randomness source is broken
 func randomString(n int) string {
-	rand.Seed(time.Now().UnixNano())
-	sb := strings.Builder{}
-	sb.Grow(n)
-	for i := 0; i < n; i++ {
-		sb.WriteByte(charset[rand.Intn(len(charset))])
+	s, err := secureRandomString(n)
+	if err != nil {
+		log.Print("fatal", "failed to generate random string: %v", err)
 	}
-	return sb.String()
+	return s
 }
 
 func (p *Paste) NewPaste(src *PasteBody) error {
@@ -204,10 +356,22 @@ func (p *Paste) NewPaste(src *PasteBody) error {
 	}
 	p.Content = src.Content
 
-	// Default to plaintext if not set
-	p.FileType = "plaintext"
+	// Detect the filetype if not set, falling back to plaintext
+	p.Filename = src.Filename
 	if src.FileType != "" {
-		p.FileType = src.FileType
+		filetype, ok := normalizeFileType(src.FileType)
+		if !ok {
+			return fmt.Errorf("Unknown filetype: %s", src.FileType)
+		}
+		p.FileType = filetype
+	} else {
+		detected := detectFileType(src.Filename, src.Content)
+		p.FileType = detected.FileType
+		p.Detected = &detected
+	}
+
+	if err := p.setMetadata(src); err != nil {
+		return err
 	}
 
 	// Default expiration time to 14 days if not set or set outside
@@ -223,12 +387,14 @@ func (p *Paste) NewPaste(src *PasteBody) error {
 
 	p.UUID = uuid.New().String()
 	p.AccessKey = randomString(25)
+	p.Revision = 1
+	p.UpdatedAt = primitive.NewDateTimeFromTime(now)
 
 	return nil
 }
 
 func (p *Paste) EditPaste(src *PasteBody) error {
-	if src.Content == nil && src.ExpiresIn == 0 && src.FileType == "" {
+	if src.Content == nil && src.ExpiresIn == 0 && src.FileType == "" && src.Filename == "" && !src.hasMetadata() {
 		return errors.New("No updates given")
 	}
 
@@ -236,23 +402,40 @@ func (p *Paste) EditPaste(src *PasteBody) error {
 	if src.Content != nil && reflect.DeepEqual(src.Content, p.Content) {
 		return errors.New("No changes made to content field")
 	}
-	if src.FileType != "" && src.FileType == p.FileType {
-		return errors.New("No changes made to filetype field")
+	filetype := ""
+	if src.FileType != "" {
+		var ok bool
+		if filetype, ok = normalizeFileType(src.FileType); !ok {
+			return fmt.Errorf("Unknown filetype: %s", src.FileType)
+		}
+		if filetype == p.FileType && p.Detected == nil {
+			return errors.New("No changes made to filetype field")
+		}
 	}
 	if src.ExpiresIn != 0 && src.ExpiresIn <= 0 || src.ExpiresIn > 30 {
 		return errors.New("Expiration time outside valid range")
 	}
-
-	if src.AccessKey != "" {
-		p.AccessKey = src.AccessKey
+	if err := p.setMetadata(src); err != nil {
+		return err
 	}
 
 	// Apply changes
 	if src.Content != nil {
 		p.Content = src.Content
 	}
-	if src.FileType != "" {
-		p.FileType = src.FileType
+	if src.Filename != "" {
+		p.Filename = src.Filename
+	}
+
+	// A filetype given by the client always overrides a detected one,
+	// otherwise re-run detection if the content or filename changed
+	if filetype != "" {
+		p.FileType = filetype
+		p.Detected = nil
+	} else if p.Detected != nil && (src.Content != nil || src.Filename != "") {
+		detected := detectFileType(p.Filename, p.Content)
+		p.FileType = detected.FileType
+		p.Detected = &detected
 	}
 
 	// Set new expiration date defaulting to 14 days
@@ -265,9 +448,84 @@ func (p *Paste) EditPaste(src *PasteBody) error {
 	diff := now.Add(twoWeeks)
 	p.ExpiresAt = primitive.NewDateTimeFromTime(diff)
 
+	p.Revision++
+	p.UpdatedAt = primitive.NewDateTimeFromTime(now)
+
 	return nil
 }
 
+// Fields of a paste that are returned to clients, never the access key
+func (p *Paste) response() map[string]interface{} {
+	response := make(map[string]interface{})
+	response["content"] = p.Content
+	response["filetype"] = p.FileType
+	response["expiresAt"] = p.ExpiresAt.Time().String()
+	if p.Filename != "" {
+		response["filename"] = p.Filename
+	}
+	if p.Detected != nil {
+		response["detected"] = p.Detected
+	}
+	if p.UpdatedAt != 0 {
+		response["updatedAt"] = p.UpdatedAt.Time().String()
+	}
+	if p.Revision != 0 {
+		response["revision"] = p.Revision
+	}
+	if p.Title != "" {
+		response["title"] = p.Title
+	}
+	if p.Description != "" {
+		response["description"] = p.Description
+	}
+	if len(p.Tags) > 0 {
+		response["tags"] = p.Tags
+	}
+	response["public"] = p.Public
+
+	// SHA-256 of the raw content so clients can verify what they received
+	if p.ContentHash != "" {
+		response["contentHash"] = p.ContentHash
+	} else {
+		response["contentHash"] = contentHash(p.Content)
+	}
+	return response
+}
+
+// Optional fields that are empty on the paste and so need to be removed
+// from the stored document when it is updated
+func unsetFields(p *Paste) bson.M {
+	unset := bson.M{}
+	if p.Detected == nil {
+		unset["detected"] = ""
+	}
+	if p.Content == nil {
+		unset["content"] = ""
+	}
+	if p.Codec == "" {
+		unset["codec"] = ""
+		unset["data"] = ""
+	}
+	if p.StoredSize == 0 {
+		unset["storedSize"] = ""
+	}
+	// Replaced by searchTerms, see search.go
+	unset["searchText"] = ""
+	for field, empty := range map[string]bool{
+		"title":       p.Title == "",
+		"description": p.Description == "",
+		"tags":        len(p.Tags) == 0,
+		"public":      !p.Public,
+		"private":     !p.Private,
+		"searchTerms": len(p.SearchTerms) == 0,
+	} {
+		if empty {
+			unset[field] = ""
+		}
+	}
+	return unset
+}
+
 func toBsonDoc(p *Paste) (bson.D, error) {
 	var doc bson.D
 	data, err := bson.Marshal(p)
@@ -279,34 +537,34 @@ func toBsonDoc(p *Paste) (bson.D, error) {
 	return doc, err
 }
 
-func bsonToPaste(b bson.M) (Paste, error) {
-	var paste Paste
-	doc, err := bson.Marshal(b)
-	if err != nil {
-		return paste, errors.New("Error marshalling BSON document")
-	}
-	err = bson.Unmarshal(doc, &paste)
-	if err != nil {
-		return paste, errors.New("Error unmarshalling BSON byte stream")
-	}
-
-	return paste, err
-}
-
 /* POST /api/new
 r.Body:
 	"content"   -> required
-	"filetype"  -> optional
+	"filetype"  -> optional (detected from the content if not given)
+	"filename"  -> optional (used to detect the filetype)
 	"expiresIn" -> optional (NUMBER OF DAYS)
+	"title"       -> optional
+	"description" -> optional
+	"tags"        -> optional (up to 10)
+	"public"      -> optional (list the paste at /api/pastes)
+	"private"     -> optional (only readable with a key)
+r.Header:
+	"X-Paste-PoW" -> required when anonymous and pow-difficulty is set (see
+	                 GET /api/challenge)
 
 Creates a new Paste in the MongoDB database and returns a JSON document
 {
 	uuid:		UUID,
-	content:	[]String,
 	filetype:	String,
+	detected:	{ filetype: String, confidence: Number, method: String },
 	accessKey:  String,
-	expires:	Date
+	expiresAt:	Date,
+	contentHash:	String,
+	readKey:	String (only for private pastes),
+	secrets:	[{ type: String, line: Number, endLine: Number }, ...]
 }
+secrets lists credentials found in the content (see secret-scan), if the
+policy is to reject them the paste is refused with 422 Unprocessable Entity
 */
 func (h *Handler) createPaste() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -319,6 +577,11 @@ func (h *Handler) createPaste() http.HandlerFunc {
 			)
 		}()
 
+		// Anonymous clients may need to have done some work first
+		if !h.checkProofOfWork(w, r) {
+			return
+		}
+
 		// Load body into struct
 		var paste Paste
 		var body PasteBody
@@ -338,25 +601,72 @@ func (h *Handler) createPaste() http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		secrets, err := paste.scanContent()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if user := requestUser(r); user != nil {
+			paste.Owner = user.Username
+		} else {
+			paste.Client = h.clientHash(r)
+		}
+		if !h.checkQuota(w, r, &paste, contentSize(paste.Content)) {
+			return
+		}
+
+		// Private pastes need a key to be read so give the creator one to
+		// share
+		readKey := ""
+		if paste.Private {
+			var err error
+			if readKey, _, err = paste.issueKey(roleRead); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		stored, err := h.storeContent(r.Context(), &paste)
+		if err != nil {
+			log.Print("error", "%v", err)
+			http.Error(w, "Error storing paste content", http.StatusInternalServerError)
+			return
+		}
+		stored.SearchTerms = paste.searchTerms()
 
-		doc, err := toBsonDoc(&paste)
+		doc, err := toBsonDoc(stored)
 		if err != nil {
 			log.Print("error", "%v", err)
+			h.dropBlobRef(stored.ContentHash)
 			http.Error(w, "Error converting request body to BSON document", http.StatusInternalServerError)
+			return
 		}
 
 		// Create document
-		coll := h.Client.Database(dbName).Collection(collName)
+		coll := h.database().Collection(collName)
 		_, err = coll.InsertOne(context.TODO(), doc)
 		if err != nil {
+			h.dropBlobRef(stored.ContentHash)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		h.addUsage(int64(stored.Size), 1)
 
-		response := make(map[string]string)
+		response := make(map[string]interface{})
 		response["uuid"] = paste.UUID
 		response["accessKey"] = paste.AccessKey
 		response["expiresAt"] = paste.ExpiresAt.Time().String()
+		response["filetype"] = paste.FileType
+		response["contentHash"] = stored.ContentHash
+		if readKey != "" {
+			response["readKey"] = readKey
+		}
+		if secrets != nil {
+			response["secrets"] = secrets
+		}
+		if paste.Detected != nil {
+			response["detected"] = paste.Detected
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -368,15 +678,31 @@ func (h *Handler) createPaste() http.HandlerFunc {
 }
 
 /* GET /api/{uuid}
+Query:
+	"key"     -> required for private pastes (any key issued for the paste)
+	"lines"   -> optional (line range e.g. 100-200)
+	"tail"    -> optional (number of lines from the end)
+	"grep"    -> optional (regular expression)
+	"context" -> optional (lines of context around grep matches)
 
 Returns the Paste from the MongoDB database with the matching UUID in JSON
 {
-	uuid:		UUID,
 	content:	[]String,
 	filetype:	String,
-	accessKey:  String,
-	expires:	Date
+	expiresAt:	Date,
+	updatedAt:	Date,
+	revision:	Number,
+	title:		String,
+	description:	String,
+	tags:		[]String,
+	public:		Boolean,
+	contentHash:	String (hex SHA-256 of the full raw content),
+	lines:		[]Number (only when a view is requested),
+	totalLines:	Number (only when a view is requested)
 }
+
+Responses carry an ETag and Last-Modified header and conditional requests
+using If-None-Match or If-Modified-Since are answered with 304 Not Modified
 */
 func (h *Handler) getPaste() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -391,33 +717,37 @@ func (h *Handler) getPaste() http.HandlerFunc {
 
 		uuidStr, _ := mux.Vars(r)["uuid"]
 
-		// Fetch document matching UUID from database
-		coll := h.Client.Database(dbName).Collection(collName)
-		var result bson.M
-		filter := bson.M{"uuid": uuidStr}
-		project := bson.M{
-			"_id":       0,
-			"accessKey": 0,
-			"uuid":      0,
+		view, err := parseLineView(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		err := coll.FindOne(
-			context.TODO(),
-			filter,
-			options.FindOne().SetProjection(project),
-		).Decode(&result)
-
+		// Fetch document matching UUID from database
+		paste, err := h.findReadablePaste(r, uuidStr)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				http.Error(w, "No document found with that UUID", http.StatusBadRequest)
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Convert to long date format
-		result["expiresAt"] = primitive.DateTime(result["expiresAt"].(primitive.DateTime)).Time().String()
+		if checkNotModified(w, r, paste) {
+			return
+		}
+
+		// Only return the requested lines and their line numbers
+		result := paste.response()
+		if view != nil {
+			result["content"], result["lines"] = view.apply(paste.Content)
+			result["totalLines"] = len(paste.Content)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(result); err != nil {
@@ -429,17 +759,30 @@ func (h *Handler) getPaste() http.HandlerFunc {
 
 /* PUT /api/{uuid}
 r.Body:
-	"accessKey"   -> required
+	"accessKey"   -> required (the access key or an edit key, unless
+	                 authenticated as the paste's owner)
 	"content"	  -> optional
 	"filetype"    -> optional
+	"filename"    -> optional
 	"expiresIn"   -> optional
-	^ At least one of the 3 optional fields must be updated
+	"title"       -> optional (empty to remove)
+	"description" -> optional (empty to remove)
+	"tags"        -> optional (empty to remove)
+	"public"      -> optional
+	"private"     -> optional
+	^ At least one of the optional fields must be updated
 
 Updates an existing Paste in the MongoDB database and returns a JSON document
 {
 	uuid:		UUID,
-	expiresAt:	Date
+	expiresAt:	Date,
+	revision:	Number,
+	secrets:	[{ type: String, line: Number, endLine: Number }, ...]
 }
+
+If-Match can be sent with the ETag of the paste as it was read, if the paste
+has changed since then the update is rejected with 412 Precondition Failed
+rather than overwriting the other change
 */
 func (h *Handler) updatePaste() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -468,71 +811,145 @@ func (h *Handler) updatePaste() http.HandlerFunc {
 		}
 
 		// Get and load current document state
-		coll := h.Client.Database(dbName).Collection(collName)
-		var result bson.M
-		filter := bson.M{"uuid": uuidStr}
-		project := bson.M{
-			"_id": 0,
-		}
-
-		err := coll.FindOne(
-			context.TODO(),
-			filter,
-			options.FindOne().SetProjection(project),
-		).Decode(&result)
-
+		paste, err := h.loadPaste(r.Context(), uuidStr)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				http.Error(w, "No document found with that UUID", http.StatusBadRequest)
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// Convert BSON result to Paste struct
-		paste, err := bsonToPaste(result)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Check the sender can actually edit the paste, edit keys can't change
+		// who can see it
+		role := paste.role(r, body.AccessKey)
+		if role != roleOwner && role != roleEdit {
+			http.Error(w, "Invalid access key", http.StatusUnauthorized)
+			return
+		}
+		if role == roleEdit && (body.Public != nil || body.Private != nil) {
+			http.Error(w, "Edit keys can't change the visibility of a paste", http.StatusForbidden)
+			return
+		}
+
+		// Check the client is editing the revision it expects to be
+		if im := r.Header.Get("If-Match"); im != "" && !matchesETag(im, paste.etag()) {
+			http.Error(w, "Paste has been modified since it was read", http.StatusPreconditionFailed)
 			return
 		}
 
 		// Update Paste and check for errors
+		revision, expiresAt := paste.Revision, paste.ExpiresAt
+		oldSize := contentSize(paste.Content)
 		if err := paste.EditPaste(&body); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		var secrets []SecretFinding
+		if body.Content != nil {
+			if secrets, err = paste.scanContent(); err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		growth := contentSize(paste.Content) - oldSize
+		if !h.checkQuota(w, r, paste, growth) {
+			return
+		}
+
+		// Point the paste at the blob for its new content, pastes stored
+		// before blobs are moved into one on their first edit
+		oldHash := paste.ContentHash
+		retained := body.Content != nil || oldHash == ""
+		var stored *Paste
+		if retained {
+			stored, err = h.storeContent(r.Context(), paste)
+			if err != nil {
+				log.Print("error", "%v", err)
+				http.Error(w, "Error storing paste content", http.StatusInternalServerError)
+				return
+			}
+		} else {
+			if err := h.extendBlob(r.Context(), oldHash, paste.ExpiresAt); err != nil {
+				log.Print("error", "%v", err)
+				http.Error(w, "Error storing paste content", http.StatusInternalServerError)
+				return
+			}
+			unchanged := *paste
+			unchanged.Content = nil
+			stored = &unchanged
+		}
+
+		// Undo the reference taken above if the update doesn't go through
+		failed := true
+		defer func() {
+			if !retained {
+				return
+			}
+			if failed {
+				h.dropBlobRef(stored.ContentHash)
+			} else if oldHash != "" {
+				h.dropBlobRef(oldHash)
+			}
+		}()
+
+		// Keys are only changed through the keys endpoints and moderation
+		// state by moderators
+		stored.Keys = nil
+		stored.AccessKey = ""
+		stored.Hidden = false
+		stored.Reported = false
 
 		// Convert updated paste to BSON document
-		doc, err := toBsonDoc(&paste)
+		stored.SearchTerms = paste.searchTerms()
+		doc, err := toBsonDoc(stored)
 		if err != nil {
 			log.Print("error", "%v", err)
 			http.Error(w, "Error converting request body to BSON document", http.StatusInternalServerError)
-		}
-
-		// Check the sender can actually edit the paste
-		if paste.AccessKey != result["accessKey"] {
-			http.Error(w, "Invalid access key", http.StatusUnauthorized)
 			return
 		}
 
-		// Update document
-		filter = bson.M{"uuid": uuidStr}
+		// Update document only if no other update has happened since it was
+		// read and the access key hasn't been rotated, pastes created before
+		// revisions were added have none
+		filter := bson.M{"uuid": uuidStr, "accessKey": paste.AccessKey, "revision": revision}
+		if revision == 0 {
+			filter["revision"] = bson.M{"$exists": false}
+		}
 		update := bson.M{"$set": doc}
-		res, err := coll.UpdateOne(context.TODO(), filter, update)
+		if unset := unsetFields(stored); len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		res, err := h.pastes().UpdateOne(r.Context(), filter, update)
+		h.cache.remove(uuidStr)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		if res.MatchedCount == 0 || res.ModifiedCount == 0 {
+		if res.MatchedCount == 0 {
+			http.Error(w, "Paste has been modified since it was read", http.StatusPreconditionFailed)
+			return
+		}
+		if res.ModifiedCount == 0 {
 			http.Error(w, "Error matching and updating document", http.StatusInternalServerError)
 			return
 		}
+		failed = false
+		h.addUsage(int64(growth), 0)
+		if paste.ExpiresAt != expiresAt {
+			h.expireComments(r.Context(), uuidStr, paste.ExpiresAt)
+		}
 
-		response := make(map[string]string)
+		response := make(map[string]interface{})
 		response["uuid"] = uuidStr
 		response["expiresAt"] = paste.ExpiresAt.Time().String()
+		response["revision"] = paste.Revision
+		if secrets != nil {
+			response["secrets"] = secrets
+		}
 
+		w.Header().Set("ETag", paste.etag())
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -543,7 +960,7 @@ func (h *Handler) updatePaste() http.HandlerFunc {
 
 /* DELETE /api/{uuid}
 r.Body:
-	"accessKey"  -> required
+	"accessKey"  -> required (unless authenticated as the paste's owner)
 
 Deletes an existing Paste in the MongoDB database
 */
@@ -576,23 +993,10 @@ func (h *Handler) deletePaste() http.HandlerFunc {
 		}
 
 		// Check document exists and accessKey is the same
-		coll := h.Client.Database(dbName).Collection(collName)
-		var result bson.M
-		filter := bson.M{"uuid": uuidStr}
-		project := bson.M{
-			"_id":       0,
-			"accessKey": 1,
-		}
-
-		err := coll.FindOne(
-			context.TODO(),
-			filter,
-			options.FindOne().SetProjection(project),
-		).Decode(&result)
-
+		paste, err := h.loadPaste(r.Context(), uuidStr)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				http.Error(w, "No document found with that UUID", http.StatusBadRequest)
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -600,14 +1004,15 @@ func (h *Handler) deletePaste() http.HandlerFunc {
 		}
 
 		// Check the sender can actually edit the paste
-		if body.AccessKey != result["accessKey"] {
+		if !canModify(r, paste, body.AccessKey) {
 			http.Error(w, "Invalid access key", http.StatusUnauthorized)
 			return
 		}
 
 		// Delete matching document
-		//opts := options.Delete().SetHint(bson.D{{Key: "uuid", Value: 1}})
-		res, err := coll.DeleteOne(context.TODO(), filter, nil)
+		filter := bson.M{"uuid": uuidStr}
+		res, err := h.pastes().DeleteOne(r.Context(), filter, nil)
+		h.cache.remove(uuidStr)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -616,13 +1021,22 @@ func (h *Handler) deletePaste() http.HandlerFunc {
 			http.Error(w, "Error matching and deleting document", http.StatusInternalServerError)
 			return
 		}
+		if paste.ContentHash != "" {
+			h.dropBlobRef(paste.ContentHash)
+		}
+		h.deleteComments(r.Context(), uuidStr)
+		if _, err := h.DismissReports(r.Context(), uuidStr); err != nil {
+			log.Print("error", "%v", err)
+		}
+		h.addUsage(-int64(contentSize(paste.Content)), -1)
 
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
 /* GET /{uuid}
-Return a simple plaintext site of GET /api/{uuid} with content and other fields
+Return a simple plaintext site of GET /api/{uuid} with content and other fields,
+comments are shown after the last line they refer to
 */
 func (h *Handler) getPasteHTML() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -638,50 +1052,104 @@ func (h *Handler) getPasteHTML() http.HandlerFunc {
 		uuidStr, _ := mux.Vars(r)["uuid"]
 
 		// Fetch document matching UUID from database
-		coll := h.Client.Database(dbName).Collection(collName)
-		var result bson.M
-		filter := bson.M{"uuid": uuidStr}
-		project := bson.M{
-			"_id":       0,
-			"accessKey": 0,
-			"uuid":      0,
-		}
-
-		err := coll.FindOne(
-			context.TODO(),
-			filter,
-			options.FindOne().SetProjection(project),
-		).Decode(&result)
-
+		paste, err := h.findReadablePaste(r, uuidStr)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				http.Error(w, "No document found with that UUID", http.StatusBadRequest)
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		paste, err := bsonToPaste(result)
+		// Comments are shown inline so the validators have to cover them
+		comments, err := h.listComments(r.Context(), uuidStr)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		etag := commentsETag(paste.etag(), comments)
+		if checkNotModifiedAs(w, r, paste, etag, commentsModified(paste, comments)) {
+			return
+		}
+		byLine := commentsByLine(comments)
+
+		// Terminal output is converted from ANSI escape codes into HTML
+		if isTerminal(paste.FileType) {
+			w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			lines := ansiToHTML(paste.Content)
+			data := struct {
+				UUID        string
+				Key         string
+				Share       string
+				Title       string
+				Description string
+				Tags        []string
+				FileType    string
+				ExpiresAt   string
+				Lines       []terminalLine
+			}{
+				UUID:        uuidStr,
+				Key:         requestKey(r),
+				Share:       requestShare(r, paste),
+				Title:       paste.Title,
+				Description: paste.Description,
+				Tags:        paste.Tags,
+				FileType:    paste.FileType,
+				ExpiresAt:   paste.ExpiresAt.Time().String(),
+				Lines:       make([]terminalLine, len(lines)),
+			}
+			for i, line := range lines {
+				data.Lines[i] = terminalLine{HTML: line, Comments: byLine[i+1]}
+			}
+			if err := terminalPage.Execute(w, data); err != nil {
+				log.Print("error", "%v", err)
+			}
+			return
+		}
 
 		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 
+		if paste.Title != "" {
+			fmt.Fprintf(w, "Title:      \t%s\n", paste.Title)
+		}
 		fmt.Fprintf(w, "UUID:       \t%s\n", uuidStr)
 		fmt.Fprintf(w, "Filetype:   \t%s\n", paste.FileType)
+		if len(paste.Tags) > 0 {
+			fmt.Fprintf(w, "Tags:       \t%s\n", strings.Join(paste.Tags, ", "))
+		}
 		fmt.Fprintf(w, "Expires At: \t%s\n", paste.ExpiresAt.Time().String())
+		if paste.Description != "" {
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, paste.Description)
+		}
 		fmt.Fprintln(w)
-		for _, v := range paste.Content {
+		for i, v := range paste.Content {
 			fmt.Fprintf(w, "%s\n", v)
+			for _, c := range byLine[i+1] {
+				fmt.Fprintf(w, "  >> %s:\n", c.Heading())
+				for _, l := range strings.Split(c.Body, "\n") {
+					fmt.Fprintf(w, "  >>   %s\n", strings.TrimRight(l, "\r"))
+				}
+			}
 		}
 	}
 }
 
 /* GET /{uuid}/raw
-Return the raw content of GET /api/{uuid} in an HTML file
+Query:
+	"strip"   -> optional ("ansi" removes ANSI escape sequences)
+	"lines"   -> optional (line range e.g. 100-200)
+	"tail"    -> optional (number of lines from the end)
+	"grep"    -> optional (regular expression)
+	"context" -> optional (lines of context around grep matches)
+	"download" -> optional (sent as an attachment with the filetype's MIME type)
+
+Return the raw content of GET /api/{uuid} as plain text
 */
 func (h *Handler) getRawPasteHTML() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -696,39 +1164,64 @@ func (h *Handler) getRawPasteHTML() http.HandlerFunc {
 
 		uuidStr, _ := mux.Vars(r)["uuid"]
 
-		// Fetch document matching UUID from database
-		coll := h.Client.Database(dbName).Collection(collName)
-		var result bson.M
-		filter := bson.M{"uuid": uuidStr}
-		project := bson.M{
-			"_id":       0,
-			"accessKey": 0,
-			"uuid":      0,
+		strip := r.URL.Query().Get("strip")
+		if strip != "" && strip != "ansi" {
+			http.Error(w, "Invalid value for strip parameter", http.StatusBadRequest)
+			return
 		}
 
-		err := coll.FindOne(
-			context.TODO(),
-			filter,
-			options.FindOne().SetProjection(project),
-		).Decode(&result)
+		view, err := parseLineView(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
+		// Fetch document matching UUID from database
+		paste, err := h.findReadablePaste(r, uuidStr)
 		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				http.Error(w, "No document found with that UUID", http.StatusBadRequest)
+			if err == errPasteHidden {
+				http.Error(w, err.Error(), http.StatusUnavailableForLegalReasons)
+				return
+			}
+			if err == errPasteNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		paste, err := bsonToPaste(result)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if checkNotModified(w, r, paste) {
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-		for _, v := range paste.Content {
+		content := paste.Content
+		if strip == "ansi" {
+			content = make([]string, len(paste.Content))
+			for i, v := range paste.Content {
+				content[i] = stripANSI(v)
+			}
+		}
+
+		// Separate non-adjacent groups of lines as grep does
+		var numbers []int
+		if view != nil {
+			content, numbers = view.apply(content)
+		}
+
+		// Content is never run even if a browser decides it should be
+		w.Header().Set("Content-Security-Policy", rawCSP)
+		if _, download := r.URL.Query()["download"]; download {
+			w.Header().Set("Content-Type", rawContentType(paste.FileType))
+			w.Header().Set("Content-Disposition",
+				mime.FormatMediaType("attachment", map[string]string{"filename": downloadName(paste)}))
+		} else {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		for i, v := range content {
+			if i > 0 && numbers != nil && numbers[i] != numbers[i-1]+1 {
+				fmt.Fprintln(w, "--")
+			}
 			fmt.Fprintf(w, "%s\n", v)
 		}
 	}
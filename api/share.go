@@ -0,0 +1,250 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/viper"
+)
+
+/* Share links
+A share link lets anyone holding it read a private paste until the link
+expires, even without signing in when require-auth-read is set. Pastes that
+aren't private can't be shared as their UUID alone already reads them.
+
+Nothing is stored for a link: the paste's UUID, the action it allows and
+its expiry are signed with a key derived from the server secret and the
+paste's access key, so they are checked without a database lookup beyond
+the paste itself and every link stops working when the access key is
+rotated.
+
+Links allowing "read" work on every read route, links allowing "raw" only
+on /{uuid}/raw. Links are built from the configured base-url, or the
+raw-origin for raw links, and are relative paths when neither is set as
+the request's Host header can't be trusted.
+*/
+const (
+	shareRead string = "read"
+	shareRaw  string = "raw"
+
+	defaultShareHours int = 24
+)
+
+type shareClaims struct {
+	UUID      string `json:"uuid"`
+	Action    string `json:"act"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Parse the configured base-url, does nothing when base-url isn't set
+func (h *Handler) SetBaseURL() error {
+	base := viper.GetString("base-url")
+	if base == "" {
+		return nil
+	}
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid base-url %q, must be an http or https URL", base)
+	}
+	h.baseURL = u
+	return nil
+}
+
+// Signing purpose for share links of the paste, bound to its access key
+func sharePurpose(p *Paste) string {
+	return "share " + hashToken(p.AccessKey)
+}
+
+func (p *Paste) signShare(action string, expiresAt time.Time) (string, error) {
+	payload, err := json.Marshal(shareClaims{
+		UUID:      p.UUID,
+		Action:    action,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return signValue(sharePurpose(p), payload), nil
+}
+
+// Whether the request carries a share link for the paste that is still
+// valid and allows the route being requested
+func validShare(r *http.Request, p *Paste) bool {
+	value := r.URL.Query().Get("share")
+	if value == "" {
+		return false
+	}
+	payload, err := verifyValue(sharePurpose(p), value)
+	if err != nil {
+		return false
+	}
+	var claims shareClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return false
+	}
+	if claims.UUID != p.UUID || time.Now().Unix() >= claims.ExpiresAt {
+		return false
+	}
+
+	switch claims.Action {
+	case shareRead:
+		return true
+	case shareRaw:
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			return false
+		}
+		tmpl, _ := route.GetPathTemplate()
+		return tmpl == "/{uuid}/raw"
+	}
+	return false
+}
+
+// Share link sent with the request, if it grants access to the paste, for
+// carrying over to links on rendered pages
+func requestShare(r *http.Request, p *Paste) string {
+	if !validShare(r, p) {
+		return ""
+	}
+	return r.URL.Query().Get("share")
+}
+
+/* POST /api/{uuid}/share
+r.Body:
+	"accessKey" -> required (unless authenticated as the paste's owner)
+	"action"    -> optional ("read" or "raw", default "read")
+	"expiresIn" -> optional (NUMBER OF HOURS, default 24)
+
+Mints a link that lets anyone holding it read the paste until it expires,
+only private pastes can be shared. Links can't outlive the paste and stop working
+when the access key is rotated. Returns a JSON document
+{
+	url:		String,
+	action:		String,
+	expiresAt:	String
+}
+*/
+func (h *Handler) createShare() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() {
+			log.Print("info", "%s %s [%v]",
+				r.Method,
+				r.URL.Path,
+				time.Since(start),
+			)
+		}()
+
+		// Load body into struct
+		body := struct {
+			AccessKey string `json:"accessKey,omitempty"`
+			Action    string `json:"action,omitempty"`
+			ExpiresIn int    `json:"expiresIn,omitempty"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			var mr *badRequest
+			if errors.As(err, &mr) {
+				http.Error(w, mr.msg, mr.status)
+			} else {
+				log.Print("error", "%v", err.Error())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if body.Action == "" {
+			body.Action = shareRead
+		}
+		if body.Action != shareRead && body.Action != shareRaw {
+			http.Error(w, fmt.Sprintf("Invalid share action: %s", body.Action), http.StatusBadRequest)
+			return
+		}
+		if body.ExpiresIn < 0 {
+			http.Error(w, "Invalid expiresIn value", http.StatusBadRequest)
+			return
+		}
+		if body.ExpiresIn == 0 {
+			body.ExpiresIn = defaultShareHours
+		}
+
+		paste := h.loadOwnedPaste(w, r, body.AccessKey)
+		if paste == nil {
+			return
+		}
+		if !paste.Private {
+			http.Error(w, "Only private pastes can be shared, anyone with the UUID can read this one", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := time.Now().Add(time.Duration(body.ExpiresIn) * time.Hour)
+		if pasteExpiry := paste.ExpiresAt.Time(); expiresAt.After(pasteExpiry) {
+			expiresAt = pasteExpiry
+		}
+
+		share, err := paste.signShare(body.Action, expiresAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		base := h.baseURL
+		if body.Action == shareRaw && h.rawOrigin != nil {
+			base = h.rawOrigin
+		}
+		if base == nil {
+			base = &url.URL{Path: "/"}
+		}
+		link := base.JoinPath(paste.UUID)
+		if body.Action == shareRaw {
+			link = link.JoinPath("raw")
+		}
+		link.RawQuery = url.Values{"share": {share}}.Encode()
+
+		response := make(map[string]interface{})
+		response["url"] = link.String()
+		response["action"] = body.Action
+		response["expiresAt"] = expiresAt.UTC().String()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestValidShare(t *testing.T) {
+	viper.Set("secret", "test secret")
+	defer viper.Set("secret", "")
+
+	paste := &Paste{
+		UUID:      "0b2760aa-c673-44a8-8eed-43e21520d062",
+		AccessKey: "owner-key",
+		ExpiresAt: primitive.NewDateTimeFromTime(time.Now().Add(time.Hour)),
+	}
+	sign := func(p *Paste, action string, expiresAt time.Time) string {
+		share, err := p.signShare(action, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return share
+	}
+	later := time.Now().Add(time.Hour)
+	rotated := *paste
+	rotated.AccessKey = "rotated-key"
+	other := *paste
+	other.UUID = "ab198d09-33ce-4b51-8622-e735e665affc"
+
+	tests := []struct {
+		name  string
+		path  string
+		share string
+		want  bool
+	}{
+		{"read link on page", "/" + paste.UUID, sign(paste, shareRead, later), true},
+		{"read link on raw", "/" + paste.UUID + "/raw", sign(paste, shareRead, later), true},
+		{"raw link on raw", "/" + paste.UUID + "/raw", sign(paste, shareRaw, later), true},
+		{"raw link on page", "/" + paste.UUID, sign(paste, shareRaw, later), false},
+		{"no link", "/" + paste.UUID, "", false},
+		{"expired", "/" + paste.UUID, sign(paste, shareRead, time.Now().Add(-time.Minute)), false},
+		{"unknown action", "/" + paste.UUID, sign(paste, "write", later), false},
+		{"key rotated", "/" + paste.UUID, sign(&rotated, shareRead, later), false},
+		{"other paste", "/" + paste.UUID, sign(&other, shareRead, later), false},
+		{"tampered", "/" + paste.UUID, sign(paste, shareRead, later) + "x", false},
+		{"garbage", "/" + paste.UUID, "not-a-share", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bool
+			check := func(w http.ResponseWriter, r *http.Request) { got = validShare(r, paste) }
+			router := mux.NewRouter()
+			router.HandleFunc("/{uuid}/raw", check)
+			router.HandleFunc("/{uuid}", check)
+
+			req := httptest.NewRequest("GET", tt.path+"?share="+tt.share, nil)
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("validShare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShareWithRequireAuthRead(t *testing.T) {
+	setConfig(t, "secret", "test secret")
+	setConfig(t, authRead, true)
+
+	paste := testPaste("5d0b6a8e-3f57-4c43-9d69-0f6a3e4a1c11", "shared content")
+	paste.Private = true
+	paste.Keys = []pasteKey{{Hash: hashToken("read-key"), Role: roleRead}}
+	other := testPaste("4f1c2b9e-8a0d-4d7e-b1a5-2c3d4e5f6a7b", "other content")
+	other.Private = true
+	h := newTestHandler(t, paste, other)
+
+	read, err := paste.signShare(shareRead, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := paste.signShare(shareRaw, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := paste.signShare(shareRead, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := "/" + paste.UUID
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"no grant", base + "/raw", http.StatusUnauthorized},
+		{"api without grant", "/api/" + paste.UUID, http.StatusUnauthorized},
+		{"read link on raw", base + "/raw?share=" + read, http.StatusOK},
+		{"read link on api", "/api/" + paste.UUID + "?share=" + read, http.StatusOK},
+		{"raw link on raw", base + "/raw?share=" + raw, http.StatusOK},
+		{"raw link on page", base + "?share=" + raw, http.StatusUnauthorized},
+		{"expired link", base + "/raw?share=" + expired, http.StatusUnauthorized},
+		{"forged link", base + "/raw?share=" + read + "x", http.StatusUnauthorized},
+		{"read key", base + "/raw?key=read-key", http.StatusOK},
+		{"owner key", base + "/raw?key=" + paste.AccessKey, http.StatusOK},
+		{"wrong key", base + "/raw?key=nope", http.StatusUnauthorized},
+		{"link for another paste", "/" + other.UUID + "/raw?share=" + read, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveTest(h, "GET", tt.target, nil); w.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d: %s", tt.target, w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRawOriginRedirect(t *testing.T) {
+	setConfig(t, "secret", "test secret")
+	setConfig(t, authRead, true)
+
+	paste := testPaste("9a6c1f0e-7d2b-4e8a-a3c5-1b2d3e4f5a6b", "raw content")
+	paste.Private = true
+	paste.Owner = "alice"
+	h := newTestHandler(t, paste)
+	h.rawOrigin = &url.URL{Scheme: "https", Host: "raw.example.com"}
+	path := "/" + paste.UUID + "/raw"
+
+	tests := []struct {
+		name      string
+		user      *User
+		query     string
+		wantShare bool
+	}{
+		{"owner gets a share link", &User{Username: "alice"}, "", true},
+		{"anonymous", nil, "", false},
+		{"other user", &User{Username: "bob"}, "", false},
+		{"key kept", &User{Username: "alice"}, "key=" + paste.AccessKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, path+"?"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"uuid": paste.UUID})
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey, tt.user))
+			}
+			query, err := url.ParseQuery(h.rawOriginQuery(r))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := query.Get("share") != ""; got != tt.wantShare {
+				t.Fatalf("share link added = %v, want %v", got, tt.wantShare)
+			}
+			if !tt.wantShare {
+				return
+			}
+
+			// The share link is enough to read the paste on the raw origin
+			w := serveTest(h, http.MethodGet, "https://raw.example.com"+path+"?"+query.Encode(), nil)
+			if w.Code != http.StatusOK {
+				t.Errorf("raw origin status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+
+	w := serveTest(h, http.MethodGet, "https://raw.example.com"+path, http.Header{"Accept": {"text/html"}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("raw origin without a grant: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
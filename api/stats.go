@@ -0,0 +1,120 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Totals of how much content is stored and how much space it takes up
+type StorageStats struct {
+	Pastes      int64 `json:"pastes"`
+	Blobs       int64 `json:"blobs"`
+	Compressed  int64 `json:"compressed"`
+	RawBytes    int64 `json:"rawBytes"`
+	StoredBytes int64 `json:"storedBytes"`
+}
+
+/* Walk every paste totalling its raw size then every blob totalling the
+space taken up by content, pastes sharing a blob only count it once. Pastes
+written before blobs hold their content inline and those written before
+sizes were recorded have their size worked out from their content.
+*/
+func (h *Handler) StorageStats(ctx context.Context) (StorageStats, error) {
+	var stats StorageStats
+	project := bson.M{
+		"_id":         0,
+		"content":     1,
+		"size":        1,
+		"storedSize":  1,
+		"codec":       1,
+		"contentHash": 1,
+	}
+
+	cursor, err := h.pastes().Find(ctx, bson.M{}, options.Find().SetProjection(project))
+	if err != nil {
+		return stats, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var paste Paste
+		if err := cursor.Decode(&paste); err != nil {
+			return stats, err
+		}
+
+		size, storedSize := paste.Size, paste.StoredSize
+		if size == 0 {
+			size = contentSize(paste.Content)
+		}
+		if storedSize == 0 {
+			storedSize = size
+		}
+
+		stats.Pastes++
+		stats.RawBytes += int64(size)
+		if paste.ContentHash != "" {
+			continue
+		}
+		if paste.Codec != "" {
+			stats.Compressed++
+		}
+		stats.StoredBytes += int64(storedSize)
+	}
+	if err := cursor.Err(); err != nil {
+		return stats, err
+	}
+
+	project = bson.M{"storedSize": 1, "codec": 1}
+	blobs, err := h.blobs().Find(ctx, bson.M{}, options.Find().SetProjection(project))
+	if err != nil {
+		return stats, err
+	}
+	defer blobs.Close(ctx)
+
+	for blobs.Next(ctx) {
+		var b blob
+		if err := blobs.Decode(&b); err != nil {
+			return stats, err
+		}
+
+		stats.Blobs++
+		if b.Codec != "" {
+			stats.Compressed++
+		}
+		stats.StoredBytes += int64(b.StoredSize)
+	}
+
+	return stats, blobs.Err()
+}
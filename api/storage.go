@@ -0,0 +1,190 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/h5law/paste-server/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/* Storage helpers
+Lookups shared by the handlers so the projection and error handling for a
+missing paste only live in one place. Reads go through the cache while
+updates and deletes always load the current document.
+*/
+var errPasteNotFound = errors.New("No document found with that UUID")
+
+/* Create the indexes the server relies on, creating an index that already
+exists is a no-op. Expired pastes, blobs and comments are removed by the TTL
+indexes on expiresAt, pastes are looked up by their UUID (or listed by tag
+and searched with the text index) or by their owner, comments by the paste
+they belong to and API tokens by their user.
+*/
+func (h *Handler) ensureIndexes(ctx context.Context) error {
+	ttl := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	uuid := mongo.IndexModel{
+		Keys: bson.D{{Key: "uuid", Value: 1}},
+	}
+	public := mongo.IndexModel{
+		Keys: bson.D{{Key: "public", Value: 1}, {Key: "tags", Value: 1}, {Key: "updatedAt", Value: -1}},
+	}
+	search := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "title", Value: "text"},
+			{Key: "description", Value: "text"},
+			{Key: "tags", Value: "text"},
+			{Key: "searchTerms", Value: "text"},
+		},
+		Options: options.Index().
+			SetName(searchIndexName).
+			SetWeights(bson.M{"title": 10, "tags": 5, "description": 3, "searchTerms": 1}),
+	}
+
+	owner := mongo.IndexModel{
+		Keys: bson.D{{Key: "owner", Value: 1}, {Key: "updatedAt", Value: -1}},
+	}
+
+	client := mongo.IndexModel{
+		Keys: bson.D{{Key: "client", Value: 1}},
+	}
+	if err := h.dropStaleSearchIndex(ctx); err != nil {
+		return err
+	}
+	if _, err := h.pastes().Indexes().CreateMany(ctx, []mongo.IndexModel{ttl, uuid, public, search, owner, client}); err != nil {
+		return err
+	}
+	if _, err := h.blobs().Indexes().CreateOne(ctx, ttl); err != nil {
+		return err
+	}
+
+	paste := mongo.IndexModel{
+		Keys: bson.D{{Key: "paste", Value: 1}, {Key: "endLine", Value: 1}},
+	}
+	if _, err := h.comments().Indexes().CreateMany(ctx, []mongo.IndexModel{ttl, paste}); err != nil {
+		return err
+	}
+
+	user := mongo.IndexModel{
+		Keys: bson.D{{Key: "user", Value: 1}},
+	}
+	if _, err := h.tokens().Indexes().CreateOne(ctx, user); err != nil {
+		return err
+	}
+
+	reporter := mongo.IndexModel{
+		Keys:    bson.D{{Key: "paste", Value: 1}, {Key: "reporter", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := h.reports().Indexes().CreateMany(ctx, []mongo.IndexModel{ttl, reporter})
+	return err
+}
+
+/* A collection can only have one text index, so the search index from
+before content was indexed as searchTerms has to go before the current one
+can be created
+*/
+func (h *Handler) dropStaleSearchIndex(ctx context.Context) error {
+	cursor, err := h.pastes().Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var indexes []struct {
+		Name    string `bson:"name"`
+		Weights bson.M `bson:"weights"`
+	}
+	if err := cursor.All(ctx, &indexes); err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if _, stale := index.Weights["searchText"]; index.Name == searchIndexName && stale {
+			log.Print("info", "replacing the %s index", searchIndexName)
+			_, err := h.pastes().Indexes().DropOne(ctx, searchIndexName)
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Handler) pastes() *mongo.Collection {
+	return h.database().Collection(collName)
+}
+
+// Fetch the paste matching the UUID for reading, going through the read
+// cache, the returned paste is shared and must not be modified
+func (h *Handler) findPaste(ctx context.Context, uuidStr string) (*Paste, error) {
+	return h.cache.fetch(ctx, uuidStr, func(ctx context.Context) (*Paste, error) {
+		return h.loadPaste(ctx, uuidStr)
+	})
+}
+
+// Fetch the paste matching the UUID including its access key straight from
+// the database, callers are responsible for never returning the key to the
+// client
+func (h *Handler) loadPaste(ctx context.Context, uuidStr string) (*Paste, error) {
+	var paste Paste
+	filter := bson.M{"uuid": uuidStr}
+	project := bson.M{
+		"_id":         0,
+		"searchTerms": 0,
+	}
+
+	err := h.pastes().FindOne(
+		ctx,
+		filter,
+		options.FindOne().SetProjection(project),
+	).Decode(&paste)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errPasteNotFound
+		}
+		return nil, err
+	}
+
+	if paste.ContentHash != "" {
+		paste.Content, err = h.loadBlobContent(ctx, paste.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+	} else if err := paste.decodeContent(); err != nil {
+		return nil, err
+	}
+
+	return &paste, nil
+}
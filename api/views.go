@@ -0,0 +1,174 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* Partial views of a paste
+Large pastes (mostly logs) can be narrowed down server side with query
+parameters on the raw and JSON endpoints:
+	"lines"   -> a 1-based inclusive range "100-200", "100-" or "100"
+	"tail"    -> only the last N lines
+	"grep"    -> only lines matching the regular expression
+	"context" -> lines of context to include around each grep match
+lines and tail can't be used together, grep is applied to whatever range
+they select.
+*/
+const (
+	maxGrepLength  int = 1024
+	maxGrepContext int = 100
+)
+
+type lineView struct {
+	from    int // 1-based inclusive, 0 if unset
+	to      int // 1-based inclusive, 0 if open ended
+	tail    int
+	grep    *regexp.Regexp
+	context int
+}
+
+// Parse the view query parameters, returns nil if none were given
+func parseLineView(q url.Values) (*lineView, error) {
+	if q.Get("lines") == "" && q.Get("tail") == "" && q.Get("grep") == "" {
+		if q.Get("context") != "" {
+			return nil, errors.New("Context parameter requires grep")
+		}
+		return nil, nil
+	}
+
+	v := &lineView{}
+	if lines := q.Get("lines"); lines != "" {
+		if q.Get("tail") != "" {
+			return nil, errors.New("Lines and tail parameters can't be used together")
+		}
+		fromStr, toStr, isRange := strings.Cut(lines, "-")
+		from, err := strconv.Atoi(fromStr)
+		if err != nil || from < 1 {
+			return nil, fmt.Errorf("Invalid line range: %s", lines)
+		}
+		v.from, v.to = from, from
+		if isRange {
+			v.to = 0
+			if toStr != "" {
+				to, err := strconv.Atoi(toStr)
+				if err != nil || to < from {
+					return nil, fmt.Errorf("Invalid line range: %s", lines)
+				}
+				v.to = to
+			}
+		}
+	}
+
+	if tail := q.Get("tail"); tail != "" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid tail value: %s", tail)
+		}
+		v.tail = n
+	}
+
+	if grep := q.Get("grep"); grep != "" {
+		if len(grep) > maxGrepLength {
+			return nil, fmt.Errorf("Grep pattern must not be longer than %d characters", maxGrepLength)
+		}
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid grep pattern: %v", err)
+		}
+		v.grep = re
+	}
+
+	if c := q.Get("context"); c != "" {
+		if v.grep == nil {
+			return nil, errors.New("Context parameter requires grep")
+		}
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 0 || n > maxGrepContext {
+			return nil, fmt.Errorf("Context must be between 0 and %d", maxGrepContext)
+		}
+		v.context = n
+	}
+
+	return v, nil
+}
+
+// Select the lines of content matching the view, returning the lines and
+// their 1-based line numbers
+func (v *lineView) apply(content []string) ([]string, []int) {
+	start, end := 0, len(content)
+	if v.from > 0 {
+		start = v.from - 1
+		if v.to > 0 && v.to < end {
+			end = v.to
+		}
+	}
+	if v.tail > 0 && v.tail < end {
+		start = end - v.tail
+	}
+	if start > end {
+		start = end
+	}
+
+	// Mark every match and the context around it within the range
+	keep := make([]bool, end-start)
+	for i := range keep {
+		if v.grep == nil {
+			keep[i] = true
+			continue
+		}
+		if !v.grep.MatchString(content[start+i]) {
+			continue
+		}
+		for j := i - v.context; j <= i+v.context; j++ {
+			if j >= 0 && j < len(keep) {
+				keep[j] = true
+			}
+		}
+	}
+
+	lines := []string{}
+	numbers := []int{}
+	for i, k := range keep {
+		if k {
+			lines = append(lines, content[start+i])
+			numbers = append(numbers, start+i+1)
+		}
+	}
+
+	return lines, numbers
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLineView(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *lineView
+		wantErr bool
+	}{
+		{query: "", want: nil},
+		{query: "lines=5", want: &lineView{from: 5, to: 5}},
+		{query: "lines=2-4", want: &lineView{from: 2, to: 4}},
+		{query: "lines=3-", want: &lineView{from: 3}},
+		{query: "tail=10", want: &lineView{tail: 10}},
+		{query: "lines=0", wantErr: true},
+		{query: "lines=4-2", wantErr: true},
+		{query: "lines=a-b", wantErr: true},
+		{query: "lines=1-x", wantErr: true},
+		{query: "tail=0", wantErr: true},
+		{query: "tail=-1", wantErr: true},
+		{query: "lines=1&tail=1", wantErr: true},
+		{query: "context=2", wantErr: true},
+		{query: "lines=1&context=2", wantErr: true},
+		{query: "grep=(", wantErr: true},
+		{query: "grep=x&context=-1", wantErr: true},
+		{query: "grep=x&context=101", wantErr: true},
+		{query: "grep=" + strings.Repeat("a", maxGrepLength+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseLineView(q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLineView(%q) error = %v, want error %v", tt.query, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLineView(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+
+	// Compiled patterns can't be compared with DeepEqual
+	v, err := parseLineView(url.Values{"grep": {"^b"}, "context": {"1"}})
+	if err != nil || v.grep == nil || v.grep.String() != "^b" || v.context != 1 {
+		t.Errorf("grep view = %+v, %v", v, err)
+	}
+}
+
+func TestLineViewApply(t *testing.T) {
+	content := []string{"a", "b", "c", "d", "e", "f"}
+	tests := []struct {
+		query   string
+		lines   []string
+		numbers []int
+	}{
+		{"lines=2", []string{"b"}, []int{2}},
+		{"lines=2-4", []string{"b", "c", "d"}, []int{2, 3, 4}},
+		{"lines=5-", []string{"e", "f"}, []int{5, 6}},
+		{"lines=4-100", []string{"d", "e", "f"}, []int{4, 5, 6}},
+		{"lines=10", []string{}, []int{}},
+		{"tail=2", []string{"e", "f"}, []int{5, 6}},
+		{"tail=100", content, []int{1, 2, 3, 4, 5, 6}},
+		{"grep=[bf]", []string{"b", "f"}, []int{2, 6}},
+		{"grep=c&context=1", []string{"b", "c", "d"}, []int{2, 3, 4}},
+		{"grep=[af]&context=1", []string{"a", "b", "e", "f"}, []int{1, 2, 5, 6}},
+		{"lines=2-3&grep=.&context=5", []string{"b", "c"}, []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			v, err := parseLineView(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines, numbers := v.apply(content)
+			if !reflect.DeepEqual(lines, tt.lines) || !reflect.DeepEqual(numbers, tt.numbers) {
+				t.Errorf("apply() = %q %v, want %q %v", lines, numbers, tt.lines, tt.numbers)
+			}
+		})
+	}
+}
+
+func TestRawContentType(t *testing.T) {
+	yaml := testPaste("2c9e4b7a-1f3d-4a6b-8c0e-5d7f9a1b3c5e", "key: value")
+	yaml.FileType = "yaml"
+	html := testPaste("7e1a3c5b-9d2f-4b8a-a6c4-0e2f4a6b8d1c", "<script>alert(1)</script>")
+	html.FileType = "html"
+	html.Filename = "dir/index.html"
+	h := newTestHandler(t, yaml, html)
+
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		disposition string
+	}{
+		{"view", "/" + yaml.UUID + "/raw", "text/plain; charset=utf-8", ""},
+		{"download", "/" + yaml.UUID + "/raw?download", "application/yaml; charset=utf-8", `attachment; filename=` + yaml.UUID + ".yaml"},
+		{"active view", "/" + html.UUID + "/raw", "text/plain; charset=utf-8", ""},
+		{"active download", "/" + html.UUID + "/raw?download", "text/plain; charset=utf-8", "attachment; filename=index.html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveTest(h, http.MethodGet, tt.target, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+				t.Errorf("Content-Disposition = %q, want %q", got, tt.disposition)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/cobra"
+)
+
+var (
+	moderateCmd = &cobra.Command{
+		Use:   "moderate",
+		Short: "Review reported pastes",
+		Long: `The moderate subcommand works through the queue of pastes reported with
+POST /api/{uuid}/report in the MongoDB database given by the uri in the
+config file.
+
+Hidden pastes are kept but respond with 451 Unavailable For Legal Reasons to
+everyone but admins, hiding or deleting a paste resolves its reports while
+dismissing them leaves the paste as it is. A running server may keep
+serving a paste from its cache for up to cache-ttl seconds after it is
+hidden or deleted.`,
+	}
+
+	moderateListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List reported pastes, oldest first",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			queue, err := h.ReportQueue(context.Background())
+			if err != nil {
+				log.Print("fatal", "failed to list reports: %v", err)
+			}
+			for _, paste := range queue {
+				fmt.Printf("%s\t%d reports\n", paste.UUID, len(paste.Reports))
+				for _, report := range paste.Reports {
+					details := strings.ReplaceAll(report.Details, "\n", " ")
+					fmt.Printf("\t%s\t%s\t%s\n", report.CreatedAt.Time().String(), report.Reason, details)
+				}
+			}
+		},
+	}
+
+	moderateHideCmd = &cobra.Command{
+		Use:   "hide UUID",
+		Short: "Hide a paste from everyone but admins",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.HidePaste(context.Background(), args[0], true); err != nil {
+				log.Print("fatal", "failed to hide paste: %v", err)
+			}
+			fmt.Printf("Hid paste %s\n", args[0])
+		},
+	}
+
+	moderateUnhideCmd = &cobra.Command{
+		Use:   "unhide UUID",
+		Short: "Make a hidden paste readable again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.HidePaste(context.Background(), args[0], false); err != nil {
+				log.Print("fatal", "failed to unhide paste: %v", err)
+			}
+			fmt.Printf("Unhid paste %s\n", args[0])
+		},
+	}
+
+	moderateDeleteCmd = &cobra.Command{
+		Use:   "delete UUID",
+		Short: "Delete a paste along with its comments and reports",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.RemovePaste(context.Background(), args[0]); err != nil {
+				log.Print("fatal", "failed to delete paste: %v", err)
+			}
+			fmt.Printf("Deleted paste %s\n", args[0])
+		},
+	}
+
+	moderateDismissCmd = &cobra.Command{
+		Use:   "dismiss UUID",
+		Short: "Dismiss a paste's reports leaving it readable",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			n, err := h.DismissReports(context.Background(), args[0])
+			if err != nil {
+				log.Print("fatal", "failed to dismiss reports: %v", err)
+			}
+			fmt.Printf("Dismissed %d reports\n", n)
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(moderateCmd)
+	moderateCmd.AddCommand(moderateListCmd, moderateHideCmd, moderateUnhideCmd, moderateDeleteCmd, moderateDismissCmd)
+}
@@ -42,22 +42,48 @@ import (
 	"time"
 
 	"github.com/caddyserver/certmagic"
+	"github.com/fsnotify/fsnotify"
 	"github.com/h5law/paste-server/api"
 	log "github.com/h5law/paste-server/logger"
+	"github.com/h5law/paste-server/utils"
 	"github.com/rs/cors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	port       int
-	logFile    string
-	jsonFormat bool
-	maxUpload  int
-	secure     bool
-	domain     string
-	email      string
-	spaDir     string
+	port        int
+	logFile     string
+	jsonFormat  bool
+	maxUpload   int
+	secure      bool
+	domain      string
+	email       string
+	spaDir      string
+	cacheAge    int
+	cacheSize   int
+	cacheTTL    int
+	compressMin int
+	storeMin    int
+	storeCodec  string
+	oidcIssuer  string
+	oidcClient  string
+	oidcURL     string
+	authCreate  bool
+	authRead    bool
+	rateCreate  int
+	rateRead    int
+	rateWrite   int
+	proxies     []string
+	quotaIP     int
+	quotaUser   int
+	capacity    int
+	secretScan  string
+	powBits     int
+	powMax      int
+	powLoad     int
+	rawOrigin   string
+	baseURL     string
 
 	startCmd = &cobra.Command{
 		Use:   "start",
@@ -138,6 +164,152 @@ func init() {
 		"", "build directory of the paste-site Preact SPA to use for frontend",
 	)
 
+	startCmd.Flags().IntVarP(
+		&cacheAge,
+		"cache-max-age",
+		"",
+		60, "seconds clients may cache pastes for before revalidating",
+	)
+	startCmd.Flags().IntVarP(
+		&cacheSize,
+		"cache-size",
+		"",
+		1000, "number of pastes to keep in the in-memory read cache (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&cacheTTL,
+		"cache-ttl",
+		"",
+		30, "seconds a paste stays in the in-memory read cache",
+	)
+	startCmd.Flags().IntVarP(
+		&compressMin,
+		"compress-min-size",
+		"",
+		1024, "minimum response size in bytes before compressing",
+	)
+	startCmd.Flags().IntVarP(
+		&storeMin,
+		"storage-compress-min-size",
+		"",
+		16384, "minimum content size in bytes before compressing it in the database (0 disables)",
+	)
+	startCmd.Flags().StringVarP(
+		&storeCodec,
+		"storage-codec",
+		"",
+		"zstd", "codec used to compress content in the database (zstd or gzip)",
+	)
+
+	startCmd.Flags().StringVarP(
+		&oidcIssuer,
+		"oidc-issuer",
+		"",
+		"", "OpenID Connect issuer URL to enable logging in with",
+	)
+	startCmd.Flags().StringVarP(
+		&oidcClient,
+		"oidc-client-id",
+		"",
+		"", "OpenID Connect client ID (the secret is read from oidc-client-secret in the config file)",
+	)
+	startCmd.Flags().StringVarP(
+		&oidcURL,
+		"oidc-redirect-url",
+		"",
+		"", "external URL of /auth/callback registered with the OpenID Connect provider",
+	)
+	startCmd.Flags().BoolVarP(
+		&authCreate,
+		"require-auth-create",
+		"",
+		false, "only allow authenticated users to create pastes and comments",
+	)
+	startCmd.Flags().BoolVarP(
+		&authRead,
+		"require-auth-read",
+		"",
+		false, "only allow authenticated users to read pastes",
+	)
+	startCmd.Flags().IntVarP(
+		&rateCreate,
+		"rate-limit-create",
+		"",
+		30, "pastes and comments each client may create per minute (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&rateRead,
+		"rate-limit-read",
+		"",
+		600, "read requests each client may make per minute (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&rateWrite,
+		"rate-limit-write",
+		"",
+		120, "update and delete requests each client may make per minute (0 disables)",
+	)
+	startCmd.Flags().StringSliceVarP(
+		&proxies,
+		"trusted-proxies",
+		"",
+		[]string{}, "IPs or CIDR ranges of proxies trusted to set X-Forwarded-For",
+	)
+	startCmd.Flags().IntVarP(
+		&quotaIP,
+		"quota-ip",
+		"",
+		0, "MB of paste content each IP address may store anonymously (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&quotaUser,
+		"quota-user",
+		"",
+		500, "MB of paste content each user may store (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&capacity,
+		"storage-capacity",
+		"",
+		0, "MB of paste content the server may store in total (0 disables)",
+	)
+	startCmd.Flags().StringVarP(
+		&secretScan,
+		"secret-scan",
+		"",
+		"warn", "what to do with secrets found in pastes (off, warn, redact or reject)",
+	)
+	startCmd.Flags().IntVarP(
+		&powBits,
+		"pow-difficulty",
+		"",
+		0, "leading zero bits of proof of work required to create pastes anonymously (0 disables)",
+	)
+	startCmd.Flags().IntVarP(
+		&powMax,
+		"pow-max-difficulty",
+		"",
+		24, "most leading zero bits of proof of work required when under load",
+	)
+	startCmd.Flags().IntVarP(
+		&powLoad,
+		"pow-load",
+		"",
+		60, "anonymous pastes per minute before proof of work gets harder (0 disables)",
+	)
+	startCmd.Flags().StringVarP(
+		&rawOrigin,
+		"raw-origin",
+		"",
+		"", "separate origin to serve raw paste content from (e.g. https://usercontent.example.com)",
+	)
+	startCmd.Flags().StringVarP(
+		&baseURL,
+		"base-url",
+		"",
+		"", "public URL of the server used in share links (e.g. https://paste.example.com)",
+	)
+
 	viper.BindPFlag("port", startCmd.Flags().Lookup("port"))
 	viper.BindPFlag("logfile", startCmd.Flags().Lookup("logfile"))
 	viper.BindPFlag("json", startCmd.Flags().Lookup("json"))
@@ -146,6 +318,30 @@ func init() {
 	viper.BindPFlag("domain", startCmd.Flags().Lookup("domain"))
 	viper.BindPFlag("email", startCmd.Flags().Lookup("email"))
 	viper.BindPFlag("spa-dir", startCmd.Flags().Lookup("spa-dir"))
+	viper.BindPFlag("cache-max-age", startCmd.Flags().Lookup("cache-max-age"))
+	viper.BindPFlag("cache-size", startCmd.Flags().Lookup("cache-size"))
+	viper.BindPFlag("cache-ttl", startCmd.Flags().Lookup("cache-ttl"))
+	viper.BindPFlag("compress-min-size", startCmd.Flags().Lookup("compress-min-size"))
+	viper.BindPFlag("storage-compress-min-size", startCmd.Flags().Lookup("storage-compress-min-size"))
+	viper.BindPFlag("storage-codec", startCmd.Flags().Lookup("storage-codec"))
+	viper.BindPFlag("oidc-issuer", startCmd.Flags().Lookup("oidc-issuer"))
+	viper.BindPFlag("oidc-client-id", startCmd.Flags().Lookup("oidc-client-id"))
+	viper.BindPFlag("oidc-redirect-url", startCmd.Flags().Lookup("oidc-redirect-url"))
+	viper.BindPFlag("require-auth-create", startCmd.Flags().Lookup("require-auth-create"))
+	viper.BindPFlag("require-auth-read", startCmd.Flags().Lookup("require-auth-read"))
+	viper.BindPFlag("rate-limit-create", startCmd.Flags().Lookup("rate-limit-create"))
+	viper.BindPFlag("rate-limit-read", startCmd.Flags().Lookup("rate-limit-read"))
+	viper.BindPFlag("rate-limit-write", startCmd.Flags().Lookup("rate-limit-write"))
+	viper.BindPFlag("trusted-proxies", startCmd.Flags().Lookup("trusted-proxies"))
+	viper.BindPFlag("quota-ip", startCmd.Flags().Lookup("quota-ip"))
+	viper.BindPFlag("quota-user", startCmd.Flags().Lookup("quota-user"))
+	viper.BindPFlag("storage-capacity", startCmd.Flags().Lookup("storage-capacity"))
+	viper.BindPFlag("secret-scan", startCmd.Flags().Lookup("secret-scan"))
+	viper.BindPFlag("pow-difficulty", startCmd.Flags().Lookup("pow-difficulty"))
+	viper.BindPFlag("pow-max-difficulty", startCmd.Flags().Lookup("pow-max-difficulty"))
+	viper.BindPFlag("pow-load", startCmd.Flags().Lookup("pow-load"))
+	viper.BindPFlag("raw-origin", startCmd.Flags().Lookup("raw-origin"))
+	viper.BindPFlag("base-url", startCmd.Flags().Lookup("base-url"))
 	viper.SetDefault("port", 3000)
 	viper.SetDefault("logfile", "")
 	viper.SetDefault("json", false)
@@ -154,6 +350,39 @@ func init() {
 	viper.SetDefault("domain", "example.com")
 	viper.SetDefault("email", "admin@example.com")
 	viper.SetDefault("spa-dir", "")
+	viper.SetDefault("cache-max-age", 60)
+	viper.SetDefault("cache-size", 1000)
+	viper.SetDefault("cache-ttl", 30)
+	viper.SetDefault("compress-min-size", 1024)
+	viper.SetDefault("storage-compress-min-size", 16384)
+	viper.SetDefault("storage-codec", "zstd")
+	viper.SetDefault("oidc-issuer", "")
+	viper.SetDefault("oidc-client-id", "")
+	viper.SetDefault("oidc-client-secret", "")
+	viper.SetDefault("oidc-redirect-url", "")
+	viper.SetDefault("oidc-scopes", "openid profile email")
+	viper.SetDefault("require-auth-create", false)
+	viper.SetDefault("require-auth-read", false)
+	viper.SetDefault("rate-limit-create", 30)
+	viper.SetDefault("rate-limit-read", 600)
+	viper.SetDefault("rate-limit-write", 120)
+	viper.SetDefault("trusted-proxies", []string{})
+	viper.SetDefault("quota-ip", 0)
+	viper.SetDefault("quota-user", 500)
+	viper.SetDefault("storage-capacity", 0)
+	viper.SetDefault("secret-scan", "warn")
+	viper.SetDefault("pow-difficulty", 0)
+	viper.SetDefault("pow-max-difficulty", 24)
+	viper.SetDefault("pow-load", 60)
+	viper.SetDefault("raw-origin", "")
+	viper.SetDefault("base-url", "")
+	viper.SetDefault("spa-csp", "")
+	viper.SetDefault("access-create-allow", []string{})
+	viper.SetDefault("access-create-deny", []string{})
+	viper.SetDefault("access-read-allow", []string{})
+	viper.SetDefault("access-read-deny", []string{})
+	viper.SetDefault("access-write-allow", []string{})
+	viper.SetDefault("access-write-deny", []string{})
 }
 
 func prepareServer() {
@@ -182,6 +411,53 @@ func prepareServer() {
 	}
 }
 
+/* Reload the access lists and trusted-proxies when the config file changes
+or the process gets SIGHUP. The file is read into its own viper instance as
+the global one is read by requests without locking, so every other setting
+still needs a restart to change.
+*/
+func watchConfig(ctx context.Context, h *api.Handler) {
+	path := viper.ConfigFileUsed()
+	reload := func(v *viper.Viper) {
+		// Flags take precedence over the file as they do at startup
+		if len(proxies) > 0 {
+			v.Set("trusted-proxies", proxies)
+		}
+		if err := h.ReloadAccessLists(v); err != nil {
+			log.Print("error", "failed to reload access lists, keeping the previous ones: %v", err)
+			return
+		}
+		log.Print("info", "reloaded access lists from %s", path)
+	}
+
+	if exists, _ := utils.FileExists(path); exists {
+		watched := viper.New()
+		watched.SetConfigFile(path)
+		watched.OnConfigChange(func(e fsnotify.Event) { reload(watched) })
+		watched.WatchConfig()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				v := viper.New()
+				v.SetConfigFile(path)
+				if err := v.ReadInConfig(); err != nil {
+					log.Print("error", "failed to read config file: %v", err)
+					continue
+				}
+				reload(v)
+			}
+		}
+	}()
+}
+
 func startServer(ctx context.Context) error {
 	port := viper.GetInt("port")
 	portStr := fmt.Sprintf(":%d", port)
@@ -193,11 +469,26 @@ func startServer(ctx context.Context) error {
 	}
 
 	h := api.NewHandler()
+	if err := h.EnableOIDC(ctx); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.EnableRawOrigin(); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.SetBaseURL(); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.ReloadAccessLists(viper.GetViper()); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	watchConfig(ctx, h)
 
 	// Set up CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "X-Paste-PoW", "If-Match", "If-None-Match", "X-Paste-Key"},
+		ExposedHeaders: []string{"ETag", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 	})
 
 	handler := c.Handler(h)
@@ -261,11 +552,26 @@ func startServerTLS(ctx context.Context) error {
 	}
 
 	h := api.NewHandler()
+	if err := h.EnableOIDC(ctx); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.EnableRawOrigin(); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.SetBaseURL(); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	if err := h.ReloadAccessLists(viper.GetViper()); err != nil {
+		log.Print("fatal", "%v", err)
+	}
+	watchConfig(ctx, h)
 
 	// Set up CORS
 	c := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "X-Paste-PoW", "If-Match", "If-None-Match", "X-Paste-Key"},
+		ExposedHeaders: []string{"ETag", "Retry-After", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 	})
 
 	handler := c.Handler(h)
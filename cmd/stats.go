@@ -0,0 +1,73 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Report storage usage of the paste-server database",
+	Long: `The stats subcommand connects to the MongoDB database given by the uri
+in the config file and reports how many pastes and distinct content blobs
+are stored, how many of them are compressed and the total size of their
+content before (raw) and after (stored) deduplication and compression.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		h := connectHandler()
+		defer h.DisconnectDB()
+
+		stats, err := h.StorageStats(context.Background())
+		if err != nil {
+			log.Print("fatal", "failed to read storage stats: %v", err)
+		}
+
+		ratio := 1.0
+		if stats.RawBytes > 0 {
+			ratio = float64(stats.StoredBytes) / float64(stats.RawBytes)
+		}
+
+		fmt.Printf("Pastes:       \t%d\n", stats.Pastes)
+		fmt.Printf("Blobs:        \t%d\n", stats.Blobs)
+		fmt.Printf("Compressed:   \t%d\n", stats.Compressed)
+		fmt.Printf("Raw bytes:    \t%d\n", stats.RawBytes)
+		fmt.Printf("Stored bytes: \t%d\n", stats.StoredBytes)
+		fmt.Printf("Ratio:        \t%.2f\n", ratio)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+}
@@ -0,0 +1,230 @@
+/*
+Copyright © 2022 Harry Law <hrryslw@pm.me>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+1. Redistributions of source code must retain the above copyright notice,
+   this list of conditions and the following disclaimer.
+
+2. Redistributions in binary form must reproduce the above copyright notice,
+   this list of conditions and the following disclaimer in the documentation
+   and/or other materials provided with the distribution.
+
+3. Neither the name of the copyright holder nor the names of its contributors
+   may be used to endorse or promote products derived from this software
+   without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/h5law/paste-server/api"
+	log "github.com/h5law/paste-server/logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	userAdmin   bool
+	tokenName   string
+	linkSubject string
+	linkEmail   string
+
+	userCmd = &cobra.Command{
+		Use:   "user",
+		Short: "Manage paste-server user accounts and API tokens",
+		Long: `The user subcommand manages the optional user accounts stored in the
+MongoDB database given by the uri in the config file.
+
+Users authenticate with API tokens sent in an "Authorization: Bearer" header,
+pastes they create are owned by them and can be edited or deleted without the
+paste's access key. Tokens are only shown once when they are issued.`,
+	}
+
+	userAddCmd = &cobra.Command{
+		Use:   "add USERNAME",
+		Short: "Create a new user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.CreateUser(context.Background(), args[0], userAdmin); err != nil {
+				log.Print("fatal", "failed to create user: %v", err)
+			}
+			fmt.Printf("Created user %s\n", args[0])
+		},
+	}
+
+	userListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List all users",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			users, err := h.Users(context.Background())
+			if err != nil {
+				log.Print("fatal", "failed to list users: %v", err)
+			}
+			for _, user := range users {
+				role := "user"
+				if user.Admin {
+					role = "admin"
+				}
+				fmt.Printf("%s\t%s\t%s\n", user.Username, role, user.CreatedAt.Time().String())
+			}
+		},
+	}
+
+	userRemoveCmd = &cobra.Command{
+		Use:   "remove USERNAME",
+		Short: "Remove a user and revoke all of their tokens",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.RemoveUser(context.Background(), args[0]); err != nil {
+				log.Print("fatal", "failed to remove user: %v", err)
+			}
+			fmt.Printf("Removed user %s\n", args[0])
+		},
+	}
+
+	userTokenCmd = &cobra.Command{
+		Use:   "token USERNAME",
+		Short: "Issue a new API token for a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			token, err := h.IssueToken(context.Background(), args[0], tokenName)
+			if err != nil {
+				log.Print("fatal", "failed to issue token: %v", err)
+			}
+			fmt.Println(token)
+		},
+	}
+
+	userRevokeCmd = &cobra.Command{
+		Use:   "revoke USERNAME",
+		Short: "Revoke a user's API tokens",
+		Long: `Revoke the user's API tokens with the name given by --name, or all of
+their tokens if no name is given.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			n, err := h.RevokeTokens(context.Background(), args[0], tokenName)
+			if err != nil {
+				log.Print("fatal", "failed to revoke tokens: %v", err)
+			}
+			fmt.Printf("Revoked %d tokens\n", n)
+		},
+	}
+
+	userLinkCmd = &cobra.Command{
+		Use:   "link USERNAME",
+		Short: "Link a user to an OpenID Connect login",
+		Long: `Link the user to logins from the configured oidc-issuer with the subject
+given by --subject, or with the email address given by --email once the
+provider has verified it. Linked logins act as the user, without a link
+OpenID Connect logins are never treated as a local account.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			err := h.LinkUser(context.Background(), args[0], linkSubject, linkEmail)
+			if err != nil {
+				log.Print("fatal", "failed to link user: %v", err)
+			}
+			fmt.Printf("Linked user %s\n", args[0])
+		},
+	}
+
+	userUnlinkCmd = &cobra.Command{
+		Use:   "unlink USERNAME",
+		Short: "Remove a user's OpenID Connect link",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			h := connectHandler()
+			defer h.DisconnectDB()
+
+			if err := h.UnlinkUser(context.Background(), args[0]); err != nil {
+				log.Print("fatal", "failed to unlink user: %v", err)
+			}
+			fmt.Printf("Unlinked user %s\n", args[0])
+		},
+	}
+)
+
+// Create a handler connected to the database in the config file for
+// commands that work on the database directly
+func connectHandler() *api.Handler {
+	uri := viper.GetString("uri")
+	if uri == "" {
+		log.Print("fatal", "`uri` not set in config file")
+	}
+
+	h := api.NewHandler()
+	h.ConnectDB(uri)
+	return h
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userAddCmd, userListCmd, userRemoveCmd, userTokenCmd, userRevokeCmd,
+		userLinkCmd, userUnlinkCmd)
+
+	userAddCmd.Flags().BoolVarP(
+		&userAdmin,
+		"admin",
+		"",
+		false, "allow the user to edit and delete any paste",
+	)
+	userTokenCmd.Flags().StringVarP(
+		&tokenName,
+		"name",
+		"n",
+		"", "name to identify the token by",
+	)
+	userRevokeCmd.Flags().StringVarP(
+		&tokenName,
+		"name",
+		"n",
+		"", "only revoke tokens with this name",
+	)
+	userLinkCmd.Flags().StringVarP(
+		&linkSubject,
+		"subject",
+		"s",
+		"", "subject (sub claim) of the login to link",
+	)
+	userLinkCmd.Flags().StringVarP(
+		&linkEmail,
+		"email",
+		"e",
+		"", "verified email address of the login to link",
+	)
+}